@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// AppConfig is what nginx_app_template is executed with, one app and its id.
+type AppConfig struct {
+	Id          string
+	Environment string
+	App
+}
+
+var confFileRegexp = regexp.MustCompile(`[^0-9A-Za-z_.-]`)
+
+// confFileSuffix marks the files nixy writes, it only removes those.
+const confFileSuffix = ".nixy.conf"
+
+// confFileName turns an app id like /group/app into group_app.nixy.conf.
+func confFileName(id string) string {
+	return confFileRegexp.ReplaceAllString(strings.Trim(id, "/"), "_") + confFileSuffix
+}
+
+// renderApps renders the app template for every app, keyed by file name.
+func renderApps(appTemplate string) (map[string][]byte, error) {
+	if appTemplate == "" {
+		return nil, errors.New("nginx_app_template is required with nginx_config_dir")
+	}
+	config.RLock()
+	ids := make([]string, 0, len(config.Apps))
+	for id := range config.Apps {
+		ids = append(ids, id)
+	}
+	config.RUnlock()
+	sort.Strings(ids)
+	files := make(map[string][]byte)
+	for _, id := range ids {
+		var b bytes.Buffer
+		err := renderApp(appTemplate, id, &b)
+		if err != nil {
+			return nil, err
+		}
+		files[confFileName(id)] = b.Bytes()
+	}
+	return files, nil
+}
+
+// writeConfDir writes one file per app to dir and removes the files of apps
+// that are gone. Only *.nixy.conf files are rewritten or removed, other files
+// in dir are left alone. When nginx -t fails on the main config all files are
+// put back the way they were.
+func writeConfDir(dir string, appTemplate string, nginxConfig string) error {
+	files, err := renderApps(appTemplate)
+	if err != nil {
+		return err
+	}
+	setUpdated(&config.LastUpdates.LastConfigRendered)
+
+	existing, err := filepath.Glob(filepath.Join(dir, "*"+confFileSuffix))
+	if err != nil {
+		return err
+	}
+	// previous content of every file touched, nil for files that didn't exist.
+	previous := make(map[string][]byte)
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		old, err := ioutil.ReadFile(path)
+		if err == nil && bytes.Equal(old, content) {
+			continue
+		}
+		previous[path] = old
+		err = writeFileAtomic(path, content)
+		if err != nil {
+			restoreConfDir(previous)
+			return err
+		}
+	}
+	for _, path := range existing {
+		if _, ok := files[filepath.Base(path)]; ok {
+			continue
+		}
+		old, err := ioutil.ReadFile(path)
+		if err != nil {
+			restoreConfDir(previous)
+			return err
+		}
+		previous[path] = old
+		err = os.Remove(path)
+		if err != nil {
+			restoreConfDir(previous)
+			return err
+		}
+	}
+	if len(previous) == 0 {
+		return nil
+	}
+
+	err = checkConf(nginxConfig)
+	recordCheck(err)
+	if err != nil {
+		logger.Errorf("nginx config check failed, restoring %v, error: %v, cluster: %v", dir, err.Error(), clusterName())
+		restoreConfDir(previous)
+		return err
+	}
+	return nil
+}
+
+// restoreConfDir puts back the previous content of files, removing the ones
+// that didn't exist before.
+func restoreConfDir(previous map[string][]byte) {
+	for path, old := range previous {
+		var err error
+		if old == nil {
+			err = os.Remove(path)
+		} else {
+			err = writeFileAtomic(path, old)
+		}
+		if err != nil && !os.IsNotExist(err) {
+			logger.Errorf("unable to restore config file, error: %v, file: %v", err.Error(), path)
+		}
+	}
+}
+
+// writeFileAtomic writes through a temp file in the same directory, which
+// doesn't match *.conf, so nginx never includes a half written file.
+func writeFileAtomic(path string, content []byte) error {
+	tmpFile, err := ioutil.TempFile(filepath.Dir(path), ".nixy")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+	_, err = tmpFile.Write(content)
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpFile.Name(), path)
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestWriteConfDirKeepsOtherFiles(t *testing.T) {
+	dir := useTestNginx(t)
+	confDir := filepath.Join(dir, "conf.d")
+	if err := os.Mkdir(confDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	defer func(apps map[string]App) {
+		config.Lock()
+		config.Apps = apps
+		config.Unlock()
+	}(config.Apps)
+	appTemplate := writeTemplate(t, "# {{ .Id }}\n")
+	write := func(name string) {
+		if err := ioutil.WriteFile(filepath.Join(confDir, name), []byte("# "+name+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// written by hand, or left by nixy for an app that is gone.
+	write("default.conf")
+	write("gone.nixy.conf")
+
+	config.Lock()
+	config.Apps = map[string]App{"/shop/web": {}}
+	config.Unlock()
+	if err := writeConfDir(confDir, appTemplate, config.Nginx_config); err != nil {
+		t.Fatal(err)
+	}
+	files, err := filepath.Glob(filepath.Join(confDir, "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, file := range files {
+		names = append(names, filepath.Base(file))
+	}
+	sort.Strings(names)
+	want := []string{"default.conf", "shop_web.nixy.conf"}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("files = %v, want %v", names, want)
+	}
+}
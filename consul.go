@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+type ConsulServiceEntry struct {
+	Node struct {
+		Node    string `json:"Node"`
+		Address string `json:"Address"`
+	} `json:"Node"`
+	Service struct {
+		ID      string            `json:"ID"`
+		Service string            `json:"Service"`
+		Tags    []string          `json:"Tags"`
+		Address string            `json:"Address"`
+		Port    int64             `json:"Port"`
+		Meta    map[string]string `json:"Meta"`
+	} `json:"Service"`
+}
+
+// consulSource discovers apps from the healthy service instances in the
+// Consul catalog. Every service becomes an app with a single port, service
+// meta is used as labels.
+type consulSource struct{}
+
+func (c consulSource) Fetch(ctx context.Context) (map[string]App, error) {
+	client := &http.Client{
+		Timeout:   config.Marathon_request_timeout.Duration,
+		Transport: tr,
+	}
+	var services map[string][]string
+	_, err := consulGet(ctx, client, "/v1/catalog/services", nil, &services)
+	if err != nil {
+		return nil, err
+	}
+	apps := make(map[string]App)
+	for name := range services {
+		if excludedApp("/" + name) {
+			continue
+		}
+		var entries []ConsulServiceEntry
+		_, err := consulGet(ctx, client, "/v1/health/service/"+url.PathEscape(name), url.Values{"passing": {"true"}}, &entries)
+		if err != nil {
+			return nil, err
+		}
+		if len(entries) == 0 && !config.Include_empty_apps {
+			continue
+		}
+		var meta map[string]string
+		if len(entries) > 0 {
+			meta = entries[0].Service.Meta
+		}
+		if meta == nil {
+			meta = map[string]string{}
+		}
+		app := newApp(MarathonApp{Id: "/" + name, Labels: meta, Env: map[string]string{}}, 1)
+		app.Tasks = [][]string{[]string{}}
+		app.Backends = [][]Backend{[]Backend{}}
+		for _, entry := range entries {
+			host := entry.Service.Address
+			if host == "" {
+				host = entry.Node.Address
+			}
+			backend := Backend{Host: host, HostPort: entry.Service.Port, Weight: app.weight(0)}
+			app.Tasks[0] = append(app.Tasks[0], backend.String())
+			app.Backends[0] = append(app.Backends[0], backend)
+		}
+		apps["/"+name] = app
+	}
+	return apps, nil
+}
+
+// Watch uses consul blocking queries to queue a reload when services are
+// (de)registered or change health.
+func (c consulSource) Watch() {
+	consulWatch("/v1/catalog/services")
+	consulWatch("/v1/health/state/any")
+}
+
+func consulWatch(path string) {
+	go func() {
+		client := &http.Client{
+			Timeout:   6 * time.Minute,
+			Transport: tr,
+		}
+		var index uint64
+		for {
+			query := url.Values{"wait": {"5m"}}
+			if index > 0 {
+				query.Set("index", strconv.FormatUint(index, 10))
+			}
+			var discard interface{}
+			newindex, err := consulGet(context.Background(), client, path, query, &discard)
+			if err != nil {
+				logger.Errorf("unable to watch consul, error: %v, path: %v", err.Error(), path)
+				time.Sleep(1 * time.Second)
+				continue
+			}
+			if newindex != index {
+				if index > 0 {
+					logger.Infof("consul change received, path: %v", path)
+					queueReload()
+				}
+				index = newindex
+			}
+		}
+	}()
+}
+
+// consulGet decodes the response of a consul api call into v and returns the
+// X-Consul-Index of the response.
+func consulGet(ctx context.Context, client *http.Client, path string, query url.Values, v interface{}) (uint64, error) {
+	if query == nil {
+		query = url.Values{}
+	}
+	if config.Consul.Datacenter != "" {
+		query.Set("dc", config.Consul.Datacenter)
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", config.Consul.Addr+path+"?"+query.Encode(), nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("User-Agent", config.User_agent)
+	if config.Consul.Token != "" {
+		req.Header.Set("X-Consul-Token", config.Consul.Token)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return 0, errors.New("consul responded with " + resp.Status)
+	}
+	err = json.NewDecoder(resp.Body).Decode(v)
+	if err != nil {
+		return 0, err
+	}
+	index, _ := strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+	return index, nil
+}
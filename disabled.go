@@ -0,0 +1,64 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+// disabledSet holds the frontends taken out of rotation through
+// /v1/frontend/disable. It only lives in memory, a restart enables all again.
+type disabledSet struct {
+	sync.RWMutex
+	frontends map[string]bool
+}
+
+var disabledFrontends = disabledSet{frontends: make(map[string]bool)}
+
+// frontendId is how a frontend is written in the frontends label, like
+// shop.example.com/shop or 8080/tcp.
+func frontendId(f Frontend) string {
+	return strings.Join(f.Data, ",") + "/" + f.Type
+}
+
+// set disables or enables a frontend, it returns false when nothing changed.
+func (d *disabledSet) set(id string, disabled bool) bool {
+	d.Lock()
+	defer d.Unlock()
+	if d.frontends[id] == disabled {
+		return false
+	}
+	if disabled {
+		d.frontends[id] = true
+	} else {
+		delete(d.frontends, id)
+	}
+	return true
+}
+
+func (d *disabledSet) list() []string {
+	d.RLock()
+	defer d.RUnlock()
+	ids := make([]string, 0, len(d.frontends))
+	for id := range d.frontends {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// apply marks the disabled ones of frontends with type disabled, which no
+// template routes. They keep their place so the port indexes still line up.
+func (d *disabledSet) apply(frontends []Frontend) []Frontend {
+	d.RLock()
+	defer d.RUnlock()
+	if len(d.frontends) == 0 {
+		return frontends
+	}
+	for i, f := range frontends {
+		if f.Type != "error" && d.frontends[frontendId(f)] {
+			frontends[i] = Frontend{Type: "disabled", Data: f.Data}
+		}
+	}
+	return frontends
+}
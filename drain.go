@@ -0,0 +1,69 @@
+package main
+
+import (
+	"time"
+)
+
+// drainBackends adds the backends that are gone since the previous sync
+// back to their app as Draining, until drain_ttl passed since they were
+// first missed. They are left out of Tasks, so only templates that check
+// Draining render them, as down. Apps that are removed or scaled to zero
+// keep their frontends with only Draining backends until those expire,
+// apps that keep their last good backends are not touched.
+func drainBackends(apps map[string]App, previous map[string]App) {
+	now := time.Now()
+	for id, prev := range previous {
+		a, ok := apps[id]
+		if ok && a.LastGood {
+			continue
+		}
+		if !ok {
+			a = prev
+		}
+		if !ok || len(a.Backends) == 0 {
+			// removed, or scaled to zero and kept by include_empty_apps.
+			a = drainingApp(a, len(prev.Backends))
+		}
+		draining := false
+		for index, backends := range prev.Backends {
+			// the app changed its ports, the port indexes don't line up anymore.
+			if index >= len(a.Backends) {
+				break
+			}
+			for _, backend := range backends {
+				if containsStr(a.Tasks[index], backend.String()) {
+					continue
+				}
+				if !backend.Draining {
+					backend.Draining = true
+					backend.removedAt = now
+					logger.Infof("backend removed, draining it, app: %v, backend: %v", id, backend.String())
+				}
+				if now.Sub(backend.removedAt) >= config.Drain_ttl.Duration {
+					continue
+				}
+				a.Backends[index] = append(a.Backends[index], backend)
+				draining = true
+			}
+		}
+		if draining {
+			apps[id] = a
+		}
+	}
+}
+
+// drainingApp returns a without tasks or backends, with room for the
+// backends of ports ports to drain.
+func drainingApp(a App, ports int) App {
+	a.Tasks = make([][]string, ports)
+	a.Backends = make([][]Backend, ports)
+	for index := range a.Backends {
+		a.Tasks[index] = []string{}
+		a.Backends[index] = []Backend{}
+	}
+	a.LastGood = false
+	a.TotalTasks = 0
+	a.HealthyTasks = 0
+	a.ConfiguredInstances = 0
+	return a
+}
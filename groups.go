@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"path"
+	"time"
+)
+
+// MarathonGroup is a group of /v2/groups, only what is needed for the labels.
+type MarathonGroup struct {
+	Id     string            `json:"id"`
+	Labels map[string]string `json:"labels"`
+	Groups []MarathonGroup   `json:"groups"`
+}
+
+// fetchGroups fetches the group tree without the apps, those come from /v2/apps.
+func fetchGroups(ctx context.Context, client *http.Client, endpoint string) (MarathonGroup, error) {
+	var group MarathonGroup
+	start := time.Now()
+	req, err := http.NewRequestWithContext(ctx, "GET", apiURL(endpoint, "groups?embed=group.groups"), nil)
+	if err != nil {
+		return group, err
+	}
+	req.Header.Set("Accept", config.Marathon_accept)
+	req.Header.Set("Accept-Encoding", "gzip")
+	setMarathonHeaders(req)
+	resp, err := client.Do(req)
+	if err != nil {
+		return group, err
+	}
+	defer resp.Body.Close()
+	err = decodeResponse(resp, &group, "groups")
+	if err != nil {
+		return group, err
+	}
+	go statsTiming("marathon.groups.fetch", time.Since(start))
+	return group, nil
+}
+
+// groupLabels flattens the group tree into the labels every group passes on,
+// its own merged over the ones of its parents.
+func groupLabels(group MarathonGroup, inherited map[string]string, labels map[string]map[string]string) {
+	merged := make(map[string]string, len(inherited)+len(group.Labels))
+	for k, v := range inherited {
+		merged[k] = v
+	}
+	for k, v := range group.Labels {
+		merged[k] = v
+	}
+	id := group.Id
+	if id == "" {
+		id = "/"
+	}
+	labels[id] = merged
+	for _, child := range group.Groups {
+		groupLabels(child, merged, labels)
+	}
+}
+
+// inheritGroupLabels adds the labels of the parent groups to every app,
+// without overriding labels the app sets itself.
+func inheritGroupLabels(jsonapps *MarathonApps, root MarathonGroup) {
+	labels := make(map[string]map[string]string)
+	groupLabels(root, nil, labels)
+	for i, app := range jsonapps.Apps {
+		// the closest group known, apps may be in groups created after the fetch.
+		var inherited map[string]string
+		for id := path.Dir(app.Id); ; id = path.Dir(id) {
+			if l, ok := labels[id]; ok {
+				inherited = l
+				break
+			}
+			if id == "/" || id == "." {
+				break
+			}
+		}
+		if len(inherited) == 0 {
+			continue
+		}
+		merged := make(map[string]string, len(inherited)+len(app.Labels))
+		for k, v := range inherited {
+			merged[k] = v
+		}
+		for k, v := range app.Labels {
+			merged[k] = v
+		}
+		jsonapps.Apps[i].Labels = merged
+	}
+}
@@ -3,18 +3,28 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"compress/gzip"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"math/rand"
 	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
+	"path"
 	"path/filepath"
+	"reflect"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
-	"text/template"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
@@ -31,29 +41,54 @@ var frontendExpressions = []string{
 var frontendRegexp = regexp.MustCompile(strings.Join(frontendExpressions, "|"))
 var spaceRegexp = regexp.MustCompile("\\s+")
 
+// hostnames for nixy.server_name, optionally with a leading wildcard.
+var serverNameRegexp = regexp.MustCompile(`^(\*\.)?([0-9a-z]([0-9a-z-]*[0-9a-z])?\.)*[0-9a-z]([0-9a-z-]*[0-9a-z])?$`)
+
 type MarathonTasks struct {
-	Tasks []struct {
-		AppId              string `json:"appId"`
-		HealthCheckResults []struct {
-			Alive bool `json:"alive"`
-		} `json:"healthCheckResults"`
-		Host         string  `json:"host"`
-		Id           string  `json:"id"`
-		Ports        []int64 `json:"ports"`
-		ServicePorts []int64 `json:"servicePorts"`
-		StagedAt     string  `json:"stagedAt"`
-		StartedAt    string  `json:"startedAt"`
-		Version      string  `json:"version"`
-	} `json:"tasks"`
+	Tasks []MarathonTask `json:"tasks"`
+}
+
+type MarathonTask struct {
+	AppId              string `json:"appId"`
+	HealthCheckResults []struct {
+		Alive bool `json:"alive"`
+	} `json:"healthCheckResults"`
+	Host         string  `json:"host"`
+	Id           string  `json:"id"`
+	Ports        []int64 `json:"ports"`
+	ServicePorts []int64 `json:"servicePorts"`
+	StagedAt     string  `json:"stagedAt"`
+	StartedAt    string  `json:"startedAt"`
+	Version      string  `json:"version"`
+	// fault domain of the agent, only set by marathon versions that know about it.
+	Region string `json:"region"`
+	Zone   string `json:"zone"`
+	// task level labels, nixy.drain=true takes just this task out of routing.
+	Labels map[string]string `json:"labels"`
 }
 
 type MarathonApps struct {
-	Apps []struct {
-		Id           string            `json:"id"`
-		Labels       map[string]string `json:"labels"`
-		Env          map[string]string `json:"env"`
-		HealthChecks []interface{}     `json:"healthChecks"`
-	} `json:"apps"`
+	Apps []MarathonApp `json:"apps"`
+}
+
+type MarathonApp struct {
+	Id           string            `json:"id"`
+	Labels       map[string]string `json:"labels"`
+	Env          map[string]string `json:"env"`
+	HealthChecks []interface{}     `json:"healthChecks"`
+	Ports        []int64           `json:"ports"`
+	Instances    int               `json:"instances"`
+	Constraints  [][]string        `json:"constraints"`
+	Container    struct {
+		Docker struct {
+			PortMappings []struct {
+				ContainerPort int64  `json:"containerPort"`
+				HostPort      int64  `json:"hostPort"`
+				ServicePort   int64  `json:"servicePort"`
+				Protocol      string `json:"protocol"`
+			} `json:"portMappings"`
+		} `json:"docker"`
+	} `json:"container"`
 }
 
 func eventStream() {
@@ -64,34 +99,27 @@ func eventStream() {
 		}
 		ticker := time.NewTicker(1 * time.Second)
 		for _ = range ticker.C {
-			var endpoint string
-			for _, es := range health.Endpoints {
-				if es.Healthy == true {
-					endpoint = es.Endpoint
-					break
-				}
-			}
-			if endpoint == "" {
+			endpoints := healthyEndpoints()
+			if len(endpoints) == 0 {
 				logger.Error("all endpoints are down")
 				continue
 			}
-			req, err := http.NewRequest("GET", endpoint+"/v2/events", nil)
+			endpoint := endpoints[0]
+			req, err := http.NewRequest("GET", apiURL(endpoint, "events"), nil)
 			if err != nil {
 				logger.Errorf("unable to create event stream request, error: %v, endpoint: %v", err.Error(), endpoint)
 				continue
 			}
 			req.Header.Set("Accept", "text/event-stream")
-			if config.User != "" {
-				req.SetBasicAuth(config.User, config.Pass)
-			}
+			setMarathonHeaders(req)
 			cancel := make(chan struct{})
-			// initial request cancellation timer of 15s
-			timer := time.AfterFunc(15*time.Second, func() {
+			// initial request cancellation timer, event_stream_timeout
+			timer := time.AfterFunc(config.Event_stream_timeout.Duration, func() {
 				defer func() {
 					recover()
 				}()
 				defer close(cancel)
-				logger.Warning("event stream request was cancelled")
+				logger.Warningf("no data on the event stream for %v, cancelling the request to reconnect, endpoint: %v", config.Event_stream_timeout, endpoint)
 			})
 			req.Cancel = cancel
 			resp, err := client.Do(req)
@@ -101,166 +129,633 @@ func eventStream() {
 				timer.Reset(100 * time.Millisecond)
 				continue
 			}
+			eventStreamConnected()
+			setActiveEndpoint(&health.Active.EventStream, endpoint)
 			reader := bufio.NewReader(resp.Body)
+			var event string
 			for {
-				// reset request cancellation timer to 15s (should be >10s to avoid unnecessary reconnects
+				// reset request cancellation timer to event_stream_timeout (should be >10s to avoid unnecessary reconnects
 				// since ~10s seems to be the rate for dummy/keepalive events on the marathon event stream
-				timer.Reset(15 * time.Second)
+				timer.Reset(config.Event_stream_timeout.Duration)
 				line, err := reader.ReadString('\n')
 				if err != nil {
 					logger.Errorf("error reading Marathon event stream, error: %v, endpoint: %v", err.Error(), endpoint)
 					resp.Body.Close()
 					break
 				}
-				if !strings.HasPrefix(line, "event: ") {
+				// any line counts as liveness and has reset the timer above, SSE
+				// comments like ": keepalive" never trigger a reload.
+				if strings.HasPrefix(line, ":") {
+					logger.Debugf("event stream keepalive received, endpoint: %v", endpoint)
 					continue
 				}
-				logger.Infof("marathon event received, event: %v, endpoint: %v", strings.TrimSpace(line[6:]), endpoint)
-
-				select {
-				case eventqueue <- true: // add reload to our queue channel, unless it is full of course.
-				default:
-					logger.Warning("queue is full")
+				if strings.HasPrefix(line, "event: ") {
+					event = strings.TrimSpace(line[6:])
+					queueReload()
+					continue
+				}
+				// the data line after the event carries the ids to log, the
+				// reload is already queued.
+				if !strings.HasPrefix(line, "data: ") || event == "" {
+					continue
 				}
+				appId, deploymentId := eventIds(line[6:])
+				logger.Infof("marathon event received, event: %v, app: %v, deployment: %v, endpoint: %v", event, appId, deploymentId, endpoint)
+				event = ""
 			}
 			resp.Body.Close()
+			eventStreamDisconnected()
 			logger.Warning("event stream connection was closed, re-opening")
 		}
 	}()
 }
 
+// eventIds extracts the app and deployment id from the data of a marathon
+// event, as far as the event type has them.
+func eventIds(data string) (string, string) {
+	var payload struct {
+		AppId         string `json:"appId"`
+		Id            string `json:"id"`
+		AppDefinition struct {
+			Id string `json:"id"`
+		} `json:"appDefinition"`
+		Plan struct {
+			Id string `json:"id"`
+		} `json:"plan"`
+	}
+	if json.Unmarshal([]byte(data), &payload) != nil {
+		return "", ""
+	}
+	appId := payload.AppId
+	if appId == "" {
+		appId = payload.AppDefinition.Id
+	}
+	deploymentId := payload.Plan.Id
+	if deploymentId == "" && appId == "" {
+		// deployment_success and deployment_failed only have the id of the deployment.
+		deploymentId = payload.Id
+	}
+	return appId, deploymentId
+}
+
+// setActiveEndpoint records the endpoint now used for the event stream or
+// fetches, logging when it switched to another one.
+func setActiveEndpoint(active *string, endpoint string) {
+	health.Lock()
+	defer health.Unlock()
+	if *active == endpoint {
+		return
+	}
+	if *active != "" {
+		logger.Infof("switched marathon endpoint, from: %v, endpoint: %v", *active, endpoint)
+	}
+	*active = endpoint
+	health.Active.LastSwitch = time.Now()
+	// the new endpoint may belong to another cluster.
+	go refreshCluster(endpoint)
+}
+
+func eventStreamConnected() {
+	health.Lock()
+	defer health.Unlock()
+	es := &health.EventStream
+	if !es.LastConnect.IsZero() {
+		es.Reconnects++
+		atomic.AddInt64(&counters.reconnects, 1)
+	}
+	es.Connected = true
+	es.LastConnect = time.Now()
+}
+
+func eventStreamDisconnected() {
+	health.Lock()
+	defer health.Unlock()
+	health.EventStream.Connected = false
+	health.EventStream.DisconnectedSince = time.Now()
+}
+
+// marathonURL resolves path against the endpoint base url. Relative paths
+// stay under any prefix of the endpoint, like https://gw/marathon, while
+// absolute paths start at the root of the host.
+func marathonURL(endpoint, path string) string {
+	base, err := url.Parse(strings.TrimRight(endpoint, "/") + "/")
+	if err != nil {
+		return strings.TrimRight(endpoint, "/") + "/" + path
+	}
+	ref, err := url.Parse(path)
+	if err != nil {
+		return base.String() + path
+	}
+	return base.ResolveReference(ref).String()
+}
+
+// apiURL is the url of a versioned marathon resource like apps, below
+// marathon_api_base of the endpoint.
+func apiURL(endpoint, resource string) string {
+	base := strings.Trim(config.Marathon_api_base, "/")
+	if base == "" {
+		return marathonURL(endpoint, resource)
+	}
+	return marathonURL(endpoint, base+"/"+resource)
+}
+
+// setMarathonHeaders adds auth and the configured marathon_headers to a
+// request. Headers already set on the request, like Accept, are kept as is.
+func setMarathonHeaders(req *http.Request) {
+	req.Header.Set("User-Agent", config.User_agent)
+	// credentials can be replaced on SIGHUP.
+	config.RLock()
+	user, pass, token := config.User, config.Pass, config.Auth_token
+	config.RUnlock()
+	if user != "" {
+		req.SetBasicAuth(user, pass)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "token="+token)
+	}
+	if config.Marathon_api_version != "" {
+		req.Header.Set("Marathon-Api-Version", config.Marathon_api_version)
+	}
+	for name, value := range config.Marathon_headers {
+		if req.Header.Get(name) != "" {
+			continue
+		}
+		req.Header.Set(name, value)
+	}
+}
+
+// healthyEndpoints returns the healthy marathon endpoints in priority order.
+func healthyEndpoints() []string {
+	health.RLock()
+	defer health.RUnlock()
+	var endpoints []string
+	for _, es := range health.Endpoints {
+		if es.Healthy == true {
+			endpoints = append(endpoints, es.Endpoint)
+		}
+	}
+	return endpoints
+}
+
+func setEndpointHealth(status EndpointStatus) {
+	health.Lock()
+	defer health.Unlock()
+	for i, es := range health.Endpoints {
+		if es.Endpoint == status.Endpoint {
+			health.Endpoints[i] = status
+		}
+	}
+}
+
+// recordEndpointCheck applies a health check result with hysteresis, the
+// endpoint only flips after health_check_rises or health_check_falls
+// consecutive results that disagree with its current state.
+func recordEndpointCheck(result EndpointStatus) {
+	health.Lock()
+	defer health.Unlock()
+	for i := range health.Endpoints {
+		es := &health.Endpoints[i]
+		if es.Endpoint != result.Endpoint {
+			continue
+		}
+		if result.Healthy == es.Healthy {
+			es.Rises = 0
+			es.Falls = 0
+			es.Message = result.Message
+			continue
+		}
+		if result.Healthy {
+			es.Rises++
+			es.Falls = 0
+			if es.Rises >= config.Health_check_rises {
+				logger.Infof("endpoint is healthy again, endpoint: %v", es.Endpoint)
+				es.Healthy = true
+				es.Message = result.Message
+				es.Rises = 0
+			}
+		} else {
+			es.Falls++
+			es.Rises = 0
+			if es.Falls >= config.Health_check_falls {
+				es.Healthy = false
+				es.Message = result.Message
+				es.Falls = 0
+			}
+		}
+	}
+}
+
+// jitter sleeps a random time up to health_check_jitter, spreading the
+// health checks of many nixy instances started at once.
+func jitter() {
+	if max := config.Health_check_jitter.Duration; max > 0 {
+		time.Sleep(time.Duration(rand.Int63n(int64(max))))
+	}
+}
+
 func endpointHealth() {
 	go func() {
+		jitter()
 		ticker := time.NewTicker(10 * time.Second)
 		for {
 			select {
 			case <-ticker.C:
+				jitter()
+				health.RLock()
+				endpoints := make([]string, len(health.Endpoints))
 				for i, es := range health.Endpoints {
-					client := &http.Client{
-						Timeout:   5 * time.Second,
-						Transport: tr,
-					}
-					req, err := http.NewRequest("GET", es.Endpoint+"/ping", nil)
-					if err != nil {
-						logger.Errorf("an error occurred creating endpoint health request, error: %v, endpoint: %v", err.Error(),es.Endpoint)
-						health.Endpoints[i].Healthy = false
-						health.Endpoints[i].Message = err.Error()
-						continue
-					}
-					if config.User != "" {
-						req.SetBasicAuth(config.User, config.Pass)
-					}
-					resp, err := client.Do(req)
-					if err != nil {
-						logger.Errorf("endpoint is down, error: %v, endpoint: %v", err.Error(), es.Endpoint)
-						health.Endpoints[i].Healthy = false
-						health.Endpoints[i].Message = err.Error()
-						continue
-					}
-					resp.Body.Close()
-					if resp.StatusCode != 200 {
-						logger.Errorf("endpoint check failed, status: %s, endpoint: %v", resp.StatusCode, es.Endpoint)
-						health.Endpoints[i].Healthy = false
-						health.Endpoints[i].Message = resp.Status
-						continue
+					endpoints[i] = es.Endpoint
+				}
+				health.RUnlock()
+				// check all endpoints concurrently so slow ones don't delay the others.
+				results := make([]EndpointStatus, len(endpoints))
+				var wg sync.WaitGroup
+				for i, endpoint := range endpoints {
+					wg.Add(1)
+					go func(i int, endpoint string) {
+						defer wg.Done()
+						results[i] = checkEndpoint(endpoint)
+					}(i, endpoint)
+				}
+				wg.Wait()
+				for _, status := range results {
+					if !status.Healthy {
+						endpointDown(status.Endpoint)
 					}
-					health.Endpoints[i].Healthy = true
-					health.Endpoints[i].Message = "OK"
+					recordEndpointCheck(status)
+				}
+			}
+		}
+	}()
+}
+
+func checkEndpoint(endpoint string) EndpointStatus {
+	status := EndpointStatus{Endpoint: endpoint}
+	client := &http.Client{
+		Timeout:   config.Marathon_request_timeout.Duration,
+		Transport: tr,
+	}
+	req, err := http.NewRequest("GET", marathonURL(endpoint, config.Marathon_ping_path), nil)
+	if err != nil {
+		logger.Errorf("an error occurred creating endpoint health request, error: %v, endpoint: %v", err.Error(), endpoint)
+		status.Message = err.Error()
+		return status
+	}
+	setMarathonHeaders(req)
+	resp, err := client.Do(req)
+	if err != nil {
+		logger.Errorf("endpoint is down, error: %v, endpoint: %v", err.Error(), endpoint)
+		status.Message = err.Error()
+		return status
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		logger.Errorf("endpoint check failed, status: %v, endpoint: %v", resp.StatusCode, endpoint)
+		status.Message = resp.Status
+		return status
+	}
+	status.Healthy = true
+	status.Message = "OK"
+	return status
+}
+
+// endpointDown records a failed endpoint check, tagged with the endpoint host.
+func endpointDown(endpoint string) {
+	host := endpoint
+	if u, err := url.Parse(endpoint); err == nil && u.Host != "" {
+		host = u.Host
+	}
+	go statsCount("endpoint.down", 1, "endpoint:"+host)
+}
+
+func setReady() {
+	health.Lock()
+	defer health.Unlock()
+	health.Ready = true
+}
+
+func setLastReload(ok bool) {
+	health.Lock()
+	defer health.Unlock()
+	health.LastReloadOk = ok
+}
+
+// syncStale tells whether the last sync is older than max_sync_age, never
+// before the first sync, which readiness already covers.
+func syncStale(updates Updates) (time.Duration, bool) {
+	if config.Max_sync_age.Duration <= 0 || updates.LastSync.IsZero() {
+		return 0, false
+	}
+	age := time.Since(updates.LastSync)
+	return age, age > config.Max_sync_age.Duration
+}
+
+// syncWatchdog catches the event stream going quiet while marathon still
+// answers pings, which would otherwise leave a stale config looking healthy.
+func syncWatchdog(ctx context.Context) {
+	if config.Max_sync_age.Duration <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(10 * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				config.RLock()
+				updates := config.LastUpdates
+				config.RUnlock()
+				age, stale := syncStale(updates)
+				if !stale {
+					continue
+				}
+				logger.Warningf("no sync for %v, longer than max_sync_age %v, cluster: %v", age, config.Max_sync_age, clusterName())
+				go statsCount("sync.stale", 1)
+				if config.Stale_sync_reload {
+					queueReload()
 				}
 			}
 		}
 	}()
 }
 
-func eventWorker() {
+// eventWorker runs reloads until ctx is cancelled, the returned channel is
+// closed once it stopped, so shutdown can wait for an in-flight reload.
+func eventWorker(ctx context.Context) chan struct{} {
+	done := make(chan struct{})
 	go func() {
+		defer close(done)
+		// sync right away instead of waiting for the first event. This runs
+		// before the loop below so it can't overlap with event driven reloads.
+		err := runReload(ctx)
+		if err != nil {
+			logger.Errorf("initial sync failed, error: %v, cluster: %v", err.Error(), clusterName())
+		} else {
+			logger.Infof("initial sync succeeded, cluster: %v", clusterName())
+		}
 		// a ticker channel to limit reloads to marathon, 1s is enough for now.
 		ticker := time.NewTicker(1 * time.Second)
+		defer ticker.Stop()
 		for {
 			select {
+			case <-ctx.Done():
+				return
 			case <-ticker.C:
-				<-eventqueue
-				start := time.Now()
-				err := reload()
-				elapsed := time.Since(start)
-				if err != nil {
-					logger.Error("config update failed")
-					go statsCount("reload.failed", 1)
-				} else {
-					logger.Infof("config updated, took %v", elapsed)
-					go statsCount("reload.success", 1)
-					go statsTiming("reload.time", elapsed)
+				select {
+				case <-eventqueue:
+				case <-ctx.Done():
+					return
+				}
+				if paused() {
+					logger.Infof("reloads are paused, skipping, cluster: %v", clusterName())
+					skipReload()
+					atomic.AddInt64(&counters.reloadSkipped, 1)
+					continue
 				}
+				runReload(ctx)
 			}
 		}
 	}()
+	return done
 }
 
-func fetchApps(jsontasks *MarathonTasks, jsonapps *MarathonApps) error {
-	var endpoint string
-	for _, es := range health.Endpoints {
-		if es.Healthy == true {
-			endpoint = es.Endpoint
-			break
-		}
+func runReload(ctx context.Context) error {
+	// only one reload at a time, whoever calls it.
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+	atomic.StoreInt32(&reloadRunning, 1)
+	defer atomic.StoreInt32(&reloadRunning, 0)
+	if config.Reload_timeout.Duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, config.Reload_timeout.Duration)
+		defer cancel()
+	}
+	start := time.Now()
+	err := reload(ctx)
+	elapsed := time.Since(start)
+	if ctx.Err() == context.DeadlineExceeded {
+		logger.Errorf("reload timed out after %v, cluster: %v", elapsed, clusterName())
+		atomic.AddInt64(&counters.reloadTimeout, 1)
+		go statsCount("reload.timeout", 1, "source:"+config.Source)
 	}
-	if endpoint == "" {
-		err := errors.New("all endpoints are down")
+	if err != nil {
+		logger.Errorf("config update failed, cluster: %v", clusterName())
+		atomic.AddInt64(&counters.reloadFailed, 1)
+		setLastReload(false)
+		notifyReload(err)
+		go statsCount("reload.failed", 1, "source:"+config.Source)
 		return err
 	}
+	setReady()
+	setLastReload(true)
+	logger.Infof("config updated, took %v, cluster: %v, %v", elapsed, clusterName(), appChanges)
+	atomic.AddInt64(&counters.reloadSuccess, 1)
+	atomic.StoreInt64(&counters.lastReload, int64(elapsed))
+	notifyReload(nil)
+	go statsCount("reload.success", 1, "source:"+config.Source)
+	go statsTiming("reload.time", elapsed, "source:"+config.Source)
+	reloadTimes.add(elapsed)
+	return nil
+}
+
+// waitForEndpoints returns the healthy endpoints, waiting up to endpoint_wait
+// for one to come back when all are down, like during a leader election.
+func waitForEndpoints(ctx context.Context) []string {
+	endpoints := healthyEndpoints()
+	if len(endpoints) > 0 || config.Endpoint_wait.Duration <= 0 {
+		return endpoints
+	}
+	logger.Warningf("all endpoints are down, waiting up to %v for one to recover", config.Endpoint_wait)
+	deadline := time.Now().Add(config.Endpoint_wait.Duration)
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+	for time.Now().Before(deadline) {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+		endpoints = healthyEndpoints()
+		if len(endpoints) > 0 {
+			logger.Infof("endpoint recovered, endpoint: %v", endpoints[0])
+			return endpoints
+		}
+	}
+	return nil
+}
+
+// fetchRotation is the round-robin position over the healthy endpoints.
+var fetchRotation uint64
+
+// fetchOrder orders the healthy endpoints by endpoint_strategy. The first one
+// is fetched from, the others are the failover order.
+func fetchOrder(endpoints []string) []string {
+	if len(endpoints) < 2 {
+		return endpoints
+	}
+	switch config.Endpoint_strategy {
+	case "round-robin":
+		i := int(atomic.AddUint64(&fetchRotation, 1) % uint64(len(endpoints)))
+		return append(append([]string{}, endpoints[i:]...), endpoints[:i]...)
+	case "random":
+		shuffled := append([]string{}, endpoints...)
+		rand.Shuffle(len(shuffled), func(i, j int) { shuffled[i], shuffled[j] = shuffled[j], shuffled[i] })
+		return shuffled
+	}
+	return endpoints
+}
+
+func fetchApps(ctx context.Context, jsontasks *MarathonTasks, jsonapps *MarathonApps) error {
+	endpoints := fetchOrder(waitForEndpoints(ctx))
+	if len(endpoints) == 0 {
+		return errors.New("all endpoints are down")
+	}
+	var err error
+	for _, endpoint := range endpoints {
+		// start from a clean slate, a failed attempt may have left partial data behind.
+		*jsontasks = MarathonTasks{}
+		*jsonapps = MarathonApps{}
+		err = fetchFromEndpoint(ctx, endpoint, jsontasks, jsonapps)
+		if err == nil {
+			setActiveEndpoint(&health.Active.Fetch, endpoint)
+			return nil
+		}
+		if ctx.Err() != nil {
+			// the reload was aborted, that says nothing about the endpoint.
+			return ctx.Err()
+		}
+		logger.Errorf("unable to fetch from endpoint, error: %v, endpoint: %v", err.Error(), endpoint)
+		// mark it as down so the next reload skips it until endpointHealth says otherwise.
+		setEndpointHealth(EndpointStatus{Endpoint: endpoint, Healthy: false, Message: err.Error()})
+	}
+	return err
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// decodeResponse decodes a json response into v, unpacking it when marathon
+// sent it gzipped, and logs the size on the wire and decoded.
+func decodeResponse(resp *http.Response, v interface{}, what string) error {
+	// an error body would decode into an empty list without complaint.
+	if resp.StatusCode != 200 {
+		return errors.New("marathon responded with " + resp.Status + " for " + what)
+	}
+	wire := &countingReader{r: resp.Body}
+	var body io.Reader = wire
+	if resp.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(wire)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		body = gz
+	}
+	decoded := &countingReader{r: body}
+	err := json.NewDecoder(decoded).Decode(v)
+	if err != nil {
+		return fmt.Errorf("unable to decode marathon %v, error: %v", what, err)
+	}
+	// read to the end, a connection dropped after the json or a bad gzip
+	// checksum only shows up there and must fail the fetch as well.
+	_, err = io.Copy(ioutil.Discard, decoded)
+	if err != nil {
+		return fmt.Errorf("unable to read marathon %v, error: %v", what, err)
+	}
+	logger.Debugf("marathon %v fetched, wire size: %v, decoded size: %v", what, wire.n, decoded.n)
+	go statsGauge("marathon."+what+".bytes", int(wire.n))
+	return nil
+}
+
+// withQuery appends apps_query or tasks_query to a marathon url.
+func withQuery(u string, query string) string {
+	if query == "" {
+		return u
+	}
+	return u + "?" + query
+}
+
+func fetchFromEndpoint(ctx context.Context, endpoint string, jsontasks *MarathonTasks, jsonapps *MarathonApps) error {
 	client := &http.Client{
-		Timeout:   5 * time.Second,
+		Timeout:   config.Marathon_request_timeout.Duration,
 		Transport: tr,
 	}
 	// take advantage of goroutines and run both reqs concurrent.
 	appschn := make(chan error)
 	taskschn := make(chan error)
 	go func() {
-		req, err := http.NewRequest("GET", endpoint+"/v2/tasks", nil)
+		start := time.Now()
+		req, err := http.NewRequestWithContext(ctx, "GET", withQuery(apiURL(endpoint, "tasks"), config.Tasks_query), nil)
 		if err != nil {
 			taskschn <- err
 			return
 		}
-		req.Header.Set("Accept", "application/json")
-		if config.User != "" {
-			req.SetBasicAuth(config.User, config.Pass)
-		}
+		req.Header.Set("Accept", config.Marathon_accept)
+		// ask for gzip ourselves so the wire size can be measured.
+		req.Header.Set("Accept-Encoding", "gzip")
+		setMarathonHeaders(req)
 		resp, err := client.Do(req)
 		if err != nil {
 			taskschn <- err
 			return
 		}
 		defer resp.Body.Close()
-		decoder := json.NewDecoder(resp.Body)
-		err = decoder.Decode(&jsontasks)
+		err = decodeResponse(resp, jsontasks, "tasks")
 		if err != nil {
 			taskschn <- err
 			return
 		}
+		// a tasks_query leaving out fields we route on must not empty the config.
+		for _, task := range jsontasks.Tasks {
+			if task.AppId == "" || task.Host == "" {
+				taskschn <- errors.New("tasks without appId or host, check tasks_query")
+				return
+			}
+		}
+		go statsTiming("marathon.tasks.fetch", time.Since(start))
+		go statsGauge("marathon.tasks.count", len(jsontasks.Tasks))
 		taskschn <- nil
 	}()
 	go func() {
-		req, err := http.NewRequest("GET", endpoint+"/v2/apps", nil)
+		start := time.Now()
+		req, err := http.NewRequestWithContext(ctx, "GET", withQuery(apiURL(endpoint, "apps"), config.Apps_query), nil)
 		if err != nil {
 			appschn <- err
 			return
 		}
-		req.Header.Set("Accept", "application/json")
-		if config.User != "" {
-			req.SetBasicAuth(config.User, config.Pass)
-		}
+		req.Header.Set("Accept", config.Marathon_accept)
+		// ask for gzip ourselves so the wire size can be measured.
+		req.Header.Set("Accept-Encoding", "gzip")
+		setMarathonHeaders(req)
 		resp, err := client.Do(req)
 		if err != nil {
 			appschn <- err
 			return
 		}
 		defer resp.Body.Close()
-		decoder := json.NewDecoder(resp.Body)
-		err = decoder.Decode(&jsonapps)
+		err = decodeResponse(resp, jsonapps, "apps")
 		if err != nil {
 			appschn <- err
 			return
 		}
+		for _, app := range jsonapps.Apps {
+			if app.Id == "" {
+				appschn <- errors.New("apps without id, check apps_query")
+				return
+			}
+		}
+		go statsTiming("marathon.apps.fetch", time.Since(start))
+		go statsGauge("marathon.apps.count", len(jsonapps.Apps))
 		appschn <- nil
 	}()
 	appserr := <-appschn
@@ -271,22 +766,162 @@ func fetchApps(jsontasks *MarathonTasks, jsonapps *MarathonApps) error {
 	if taskserr != nil {
 		return taskserr
 	}
+	if config.Inherit_group_labels {
+		// frontends may come from group labels, routing without them would drop apps.
+		group, err := fetchGroups(ctx, client, endpoint)
+		if err != nil {
+			return err
+		}
+		inheritGroupLabels(jsonapps, group)
+	}
 	return nil
 }
 
-func syncApps(jsontasks *MarathonTasks, jsonapps *MarathonApps) {
-	config.Lock()
-	defer config.Unlock()
-	config.Apps = make(map[string]App)
+type MarathonInfo struct {
+	Name        string `json:"name"`
+	FrameworkId string `json:"frameworkId"`
+	Leader      string `json:"leader"`
+}
+
+func fetchInfo(endpoint string) (MarathonInfo, error) {
+	var info MarathonInfo
+	client := &http.Client{
+		Timeout:   config.Marathon_request_timeout.Duration,
+		Transport: tr,
+	}
+	req, err := http.NewRequest("GET", apiURL(endpoint, "info"), nil)
+	if err != nil {
+		return info, err
+	}
+	req.Header.Set("Accept", config.Marathon_accept)
+	setMarathonHeaders(req)
+	resp, err := client.Do(req)
+	if err != nil {
+		return info, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return info, errors.New("marathon responded with " + resp.Status)
+	}
+	err = json.NewDecoder(resp.Body).Decode(&info)
+	return info, err
+}
+
+// clusterName is the name of the marathon cluster of the active endpoint,
+// empty until it is known.
+func clusterName() string {
+	health.RLock()
+	defer health.RUnlock()
+	return health.Cluster
+}
+
+// refreshCluster reads the cluster name from /v2/info of endpoint, logging
+// when it differs from the one known so far.
+func refreshCluster(endpoint string) {
+	info, err := fetchInfo(endpoint)
+	if err != nil {
+		logger.Warningf("unable to read the cluster name, error: %v, endpoint: %v", err.Error(), endpoint)
+		return
+	}
+	name := info.Name
+	if name == "" {
+		name = info.FrameworkId
+	}
+	health.Lock()
+	previous := health.Cluster
+	health.Cluster = name
+	health.Unlock()
+	if previous != name {
+		logger.Infof("marathon cluster: %v, endpoint: %v", name, endpoint)
+	}
+}
+
+// verifyCluster warns when the configured endpoints don't all belong to the
+// same marathon cluster, judged by their framework id.
+func verifyCluster() {
+	clusters := make(map[string][]string)
+	for _, endpoint := range config.Marathon {
+		info, err := fetchInfo(endpoint)
+		if err != nil {
+			logger.Errorf("unable to verify cluster of endpoint, error: %v, endpoint: %v", err.Error(), endpoint)
+			continue
+		}
+		clusters[info.FrameworkId] = append(clusters[info.FrameworkId], endpoint)
+	}
+	if len(clusters) > 1 {
+		for id, endpoints := range clusters {
+			logger.Warningf("marathon endpoints belong to different clusters, framework id: %v, endpoints: %v", id, strings.Join(endpoints, ", "))
+		}
+		return
+	}
+	logger.Info("all reachable marathon endpoints belong to the same cluster")
+}
+
+// startupCheck fetches the apps once before serving, so wrong credentials or
+// an incompatible api show up in the log right away instead of on the first
+// event. nixy stays not ready until a sync succeeds either way.
+func startupCheck() {
+	ctx, cancel := context.WithTimeout(context.Background(), config.Marathon_request_timeout.Duration)
+	defer cancel()
+	jsontasks := MarathonTasks{}
+	jsonapps := MarathonApps{}
+	err := fetchApps(ctx, &jsontasks, &jsonapps)
+	if err != nil {
+		logger.Errorf("startup check failed, unable to fetch from marathon, error: %v", err.Error())
+		return
+	}
+	logger.Infof("startup check succeeded, apps: %v, tasks: %v, cluster: %v", len(jsonapps.Apps), len(jsontasks.Tasks), clusterName())
+}
+
+// marathonSource discovers apps through the Marathon REST API and event stream.
+type marathonSource struct{}
+
+func (m marathonSource) Fetch(ctx context.Context) (map[string]App, error) {
+	jsontasks := MarathonTasks{}
+	jsonapps := MarathonApps{}
+	err := fetchApps(ctx, &jsontasks, &jsonapps)
+	if err != nil {
+		return nil, err
+	}
+	return syncApps(&jsontasks, &jsonapps), nil
+}
+
+func (m marathonSource) Watch() {
+	endpointHealth()
+	eventStream()
+}
+
+func syncApps(jsontasks *MarathonTasks, jsonapps *MarathonApps) map[string]App {
+	apps := make(map[string]App)
+	config.RLock()
+	activeColor := config.Active_color
+	previous := config.Apps
+	config.RUnlock()
 	for _, app := range jsonapps.Apps {
+		if excludedApp(app.Id) {
+			continue
+		}
+		if !constraintMatches(app) {
+			continue
+		}
+		// blue/green, apps without a color are always routed.
+		if color, ok := app.Labels["nixy.color"]; ok && activeColor != "" && color != activeColor {
+			continue
+		}
+		total, healthy := 0, 0
 		for _, task := range jsontasks.Tasks {
 			if task.AppId != app.Id {
 				continue
 			}
+			total++
 			// lets skip tasks that does not expose any ports.
 			if len(task.Ports) == 0 {
 				continue
 			}
+			// drained tasks keep running but don't get any traffic.
+			if task.Labels["nixy.drain"] == "true" {
+				continue
+			}
 			if len(app.HealthChecks) > 0 {
 				if len(task.HealthCheckResults) == 0 {
 					// this means tasks is being deployed but not yet monitored as alive. Assume down.
@@ -304,42 +939,328 @@ func syncApps(jsontasks *MarathonTasks, jsonapps *MarathonApps) {
 					continue
 				}
 			}
-			if a, ok := config.Apps[app.Id]; ok {
-				for index, port := range task.Ports {
-					a.Tasks[index] = append(a.Tasks[index], task.Host + ":" + strconv.FormatInt(port, 10))
-					config.Apps[app.Id] = a
+			healthy++
+			a, ok := apps[app.Id]
+			if !ok {
+				a = newApp(app, len(task.Ports))
+			}
+			for index, port := range task.Ports {
+				if index >= len(a.Tasks) {
+					a.Tasks = append(a.Tasks, []string{})
+					a.Backends = append(a.Backends, []Backend{})
 				}
-			} else {
-				var newapp = App{}
-				newapp.Env = app.Env
-				newapp.Labels = app.Labels
-				newapp.Tasks = [][]string{}
-				for _, port := range task.Ports {
-					newapp.Tasks = append(newapp.Tasks, []string{task.Host + ":" + strconv.FormatInt(port, 10)})
+				backend := Backend{Host: task.Host, HostPort: port, Weight: a.weight(index), Region: task.Region, Zone: task.Zone}
+				backend.Backup = app.Labels["nixy.backup"] == "true" || task.Labels["nixy.backup"] == "true"
+				backend.startedAt, _ = time.Parse(time.RFC3339, task.StartedAt)
+				// for bridged docker apps the port mappings are in the same order as the task ports.
+				if mappings := app.Container.Docker.PortMappings; index < len(mappings) {
+					backend.ContainerPort = mappings[index].ContainerPort
 				}
-				newapp.Frontends = []Frontend{}
-				if frontendsLabel, ok := app.Labels["frontends"]; ok {
-					frontends := spaceRegexp.Split(frontendsLabel, -1)
-					if (len(frontends) <= len(task.Ports)) {
-						for _, frontend := range frontends {
-							if frontendRegexp.MatchString(frontend) {
-								frontendDataAndType := strings.Split(frontend, "/")
-								frontendType := frontendDataAndType[1]
-								frontendData := strings.Split(frontendDataAndType[0], ",")
-								newapp.Frontends = append(newapp.Frontends, Frontend{Type:frontendType, Data:frontendData})
-							} else {
-								newapp.Frontends = []Frontend{ Frontend{ Type:"error", Data:[]string{"frontend " + frontend + " not recognized" } } }
-								break
-							}
-						}
-					} else {
-						newapp.Frontends = []Frontend{ Frontend{ Type:"error", Data:[]string{"more frontends defined than ports exposed" } } }
-					}
+				// misconfigured apps can have several tasks on the same host and port.
+				if containsStr(a.Tasks[index], backend.String()) {
+					continue
 				}
-				config.Apps[app.Id] = newapp
+				a.Tasks[index] = append(a.Tasks[index], backend.String())
+				a.Backends[index] = append(a.Backends[index], backend)
 			}
+			apps[app.Id] = a
 		}
+		// mesos-dns discovery, the SRV targets replace the task backends.
+		if srvName, ok := app.Labels["nixy.srv"]; ok {
+			a, found := apps[app.Id]
+			if !found {
+				a = newApp(app, len(app.Ports))
+			}
+			resolved, err := srvBackends(a, srvName)
+			if err != nil {
+				logger.Warningf("unable to resolve srv record, keeping task backends, error: %v, app: %v", err.Error(), app.Id)
+				resolved.Errors = append(resolved.Errors, "srv lookup of "+srvName+" failed: "+err.Error())
+			}
+			if found || hasBackends(resolved) {
+				apps[app.Id] = resolved
+			}
+		}
+		if a, ok := apps[app.Id]; ok {
+			sortBackends(a)
+			backupsLast(a)
+		}
+		if config.Keep_last_good && !hasBackends(apps[app.Id]) {
+			if a, ok := lastGood(previous[app.Id], app.Id); ok {
+				apps[app.Id] = a
+			}
+		}
+		if _, ok := apps[app.Id]; !ok && config.Include_empty_apps {
+			// app is scaled to zero or has no healthy tasks, keep it around without backends.
+			apps[app.Id] = newApp(app, len(app.Ports))
+		}
+		if a, ok := apps[app.Id]; ok {
+			a.TotalTasks = total
+			a.HealthyTasks = healthy
+			a.ConfiguredInstances = app.Instances
+			apps[app.Id] = a
+		}
+	}
+	// drain first, backends verification leaves out are not gone for good.
+	if config.Drain_ttl.Duration > 0 {
+		drainBackends(apps, previous)
+	}
+	if config.Verify_backends {
+		verifyBackends(apps)
+	}
+	return apps
+}
+
+// hasBackends tells whether the app has backends to route to, draining ones don't count.
+func hasBackends(a App) bool {
+	for _, backends := range a.Backends {
+		for _, backend := range backends {
+			if !backend.Draining {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// lastGood returns the previous app with its backends when it just lost all
+// healthy tasks, until keep_last_good_ttl has passed since that happened.
+func lastGood(prev App, id string) (App, bool) {
+	if !hasBackends(prev) {
+		return App{}, false
+	}
+	if !prev.LastGood {
+		prev.LastGood = true
+		prev.unhealthySince = time.Now()
+		logger.Warningf("app has no healthy tasks, keeping its last known good backends, app: %v", id)
+	}
+	if time.Since(prev.unhealthySince) > config.Keep_last_good_ttl.Duration {
+		logger.Warningf("app has no healthy tasks for longer than keep_last_good_ttl, dropping it, app: %v", id)
+		return App{}, false
+	}
+	return prev, true
+}
+
+// sortBackends orders the backends of every port index by backend_order,
+// tasks without a valid start time go last with started.
+func sortBackends(a App) {
+	for index, backends := range a.Backends {
+		switch config.Backend_order {
+		case "host":
+			sort.SliceStable(backends, func(i, j int) bool {
+				if backends[i].Host != backends[j].Host {
+					return backends[i].Host < backends[j].Host
+				}
+				return backends[i].HostPort < backends[j].HostPort
+			})
+		case "started":
+			sort.SliceStable(backends, func(i, j int) bool {
+				ti, tj := backends[i].startedAt, backends[j].startedAt
+				if ti.IsZero() || tj.IsZero() {
+					return !ti.IsZero() && tj.IsZero()
+				}
+				return ti.Before(tj)
+			})
+		default:
+			continue
+		}
+		for i, backend := range backends {
+			a.Tasks[index][i] = backend.String()
+		}
+	}
+}
+
+// backupsLast moves the backup backends of every port index behind the
+// primary ones, keeping the task order within both.
+func backupsLast(a App) {
+	for index, backends := range a.Backends {
+		primary := []Backend{}
+		backup := []Backend{}
+		for _, backend := range backends {
+			if backend.Backup {
+				backup = append(backup, backend)
+			} else {
+				primary = append(primary, backend)
+			}
+		}
+		a.Backends[index] = append(primary, backup...)
+		for i, backend := range a.Backends[index] {
+			a.Tasks[index][i] = backend.String()
+		}
+	}
+}
+
+// constraintMatches tells whether an app has the constraint_filter, like
+// region:LIKE:us-east, among its constraints. Apps without constraints are
+// routed only with include_unconstrained.
+func constraintMatches(app MarathonApp) bool {
+	if config.Constraint_filter == "" {
+		return true
+	}
+	if len(app.Constraints) == 0 {
+		return config.Include_unconstrained
+	}
+	for _, constraint := range app.Constraints {
+		if strings.Join(constraint, ":") == config.Constraint_filter {
+			return true
+		}
+	}
+	return false
+}
+
+// excludedApp matches an app id against exclude_apps. Patterns are globs,
+// with a trailing * also matching across slashes like a prefix.
+func excludedApp(id string) bool {
+	for _, pattern := range config.Exclude_apps {
+		if strings.HasSuffix(pattern, "*") && strings.HasPrefix(id, strings.TrimSuffix(pattern, "*")) {
+			return true
+		}
+		if matched, _ := path.Match(pattern, id); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// newApp creates an App without any backends, ports is the number of ports
+// the app exposes and is used to validate the frontends label.
+func newApp(app MarathonApp, ports int) App {
+	var newapp = App{}
+	newapp.Env = app.Env
+	newapp.Labels = app.Labels
+	newapp.Tasks = [][]string{}
+	newapp.Backends = [][]Backend{}
+	newapp.Frontends = []Frontend{}
+	if frontendsLabel, ok := frontendsOf(app); ok {
+		newapp.Frontends = disabledFrontends.apply(parseFrontends(frontendsLabel, ports))
+	}
+	newapp.Errors = []string{}
+	if weightLabel, ok := app.Labels["nixy.weight"]; ok {
+		weights, err := parseWeights(weightLabel)
+		if err != nil {
+			newapp.Errors = append(newapp.Errors, err.Error())
+		}
+		newapp.weights = weights
 	}
+	newapp.ServerNames = []string{}
+	for _, name := range strings.Fields(app.Labels["nixy.server_name"]) {
+		if !serverNameRegexp.MatchString(strings.ToLower(name)) {
+			newapp.Errors = append(newapp.Errors, "server name "+name+" is not a valid hostname")
+			continue
+		}
+		newapp.ServerNames = append(newapp.ServerNames, name)
+	}
+	if keepaliveLabel, ok := app.Labels["nixy.keepalive"]; ok {
+		keepalive, err := strconv.Atoi(keepaliveLabel)
+		if err != nil || keepalive < 0 {
+			newapp.Errors = append(newapp.Errors, "keepalive "+keepaliveLabel+" is not a non-negative integer")
+		} else {
+			newapp.Keepalive = &keepalive
+		}
+	}
+	return newapp
+}
+
+// frontendsOf returns the frontends label of an app, falling back to the
+// frontends_env environment variable for legacy apps without the label.
+func frontendsOf(app MarathonApp) (string, bool) {
+	if frontends, ok := app.Labels["frontends"]; ok {
+		return frontends, true
+	}
+	if config.Frontends_env != "" {
+		if frontends, ok := app.Env[config.Frontends_env]; ok {
+			return frontends, true
+		}
+	}
+	return "", false
+}
+
+// parseWeights parses the nixy.weight label, either a single weight for all
+// ports or a space separated weight per port index.
+func parseWeights(weightLabel string) ([]int, error) {
+	var weights []int
+	for _, field := range strings.Fields(weightLabel) {
+		weight, err := strconv.Atoi(field)
+		if err != nil || weight < 1 {
+			return nil, errors.New("weight " + field + " is not a positive integer")
+		}
+		weights = append(weights, weight)
+	}
+	return weights, nil
+}
+
+// weight returns the backend weight of the port index, 1 if none was set.
+func (a App) weight(index int) int {
+	switch {
+	case len(a.weights) == 1:
+		return a.weights[0]
+	case index < len(a.weights):
+		return a.weights[index]
+	}
+	return 1
+}
+
+// parseFrontends validates the frontends label of an app against the number
+// of ports it exposes. On any problem a single frontend of type error is returned.
+func parseFrontends(frontendsLabel string, ports int) []Frontend {
+	parsed := []Frontend{}
+	frontends := spaceRegexp.Split(frontendsLabel, -1)
+	if err := checkFrontendCount(frontends, ports); err != nil {
+		return []Frontend{Frontend{Type: "error", Data: []string{err.Error()}}}
+	}
+	for _, frontend := range frontends {
+		f, err := parseFrontend(frontend)
+		if err == errFrontendNotAllowed {
+			// policy of this instance, the frontend keeps its place so the port indexes still line up.
+			parsed = append(parsed, Frontend{Type: "error", Data: []string{"frontend type " + f.Type + " is not allowed"}})
+			continue
+		}
+		if err != nil {
+			return []Frontend{Frontend{Type: "error", Data: []string{err.Error()}}}
+		}
+		parsed = append(parsed, f)
+	}
+	return parsed
+}
+
+func checkFrontendCount(frontends []string, ports int) error {
+	if len(frontends) > ports {
+		return errors.New("more frontends defined than ports exposed")
+	}
+	return nil
+}
+
+var errFrontendNotAllowed = errors.New("frontend type not allowed")
+
+// parseFrontend parses a single frontend like foo,bar/http. A frontend of a
+// type this instance doesn't route is returned with errFrontendNotAllowed.
+func parseFrontend(frontend string) (Frontend, error) {
+	if !frontendRegexp.MatchString(frontend) {
+		return Frontend{}, errors.New("frontend " + frontend + " not recognized")
+	}
+	frontendDataAndType := strings.Split(frontend, "/")
+	frontendType := frontendDataAndType[1]
+	frontendData := strings.Split(frontendDataAndType[0], ",")
+	if frontendType == "tcp" {
+		for _, port := range frontendData {
+			if p, err := strconv.Atoi(port); err != nil || p < 1 || p > 65535 {
+				return Frontend{}, errors.New("frontend " + frontend + " has an invalid port " + port)
+			}
+		}
+	}
+	f := Frontend{Type: frontendType, Data: frontendData, TCP: frontendType == "tcp"}
+	if !frontendTypeAllowed(frontendType) {
+		return f, errFrontendNotAllowed
+	}
+	return f, nil
+}
+
+// frontendTypeAllowed checks a frontend type against denied_frontend_types
+// and, when set, allowed_frontend_types.
+func frontendTypeAllowed(frontendType string) bool {
+	if containsStr(config.Denied_frontend_types, frontendType) {
+		return false
+	}
+	return len(config.Allowed_frontend_types) == 0 || containsStr(config.Allowed_frontend_types, frontendType)
 }
 
 func fileExists(fileName string) bool {
@@ -349,34 +1270,60 @@ func fileExists(fileName string) bool {
 	return false
 }
 
+func containsStr(list []string, str string) bool {
+	for _, s := range list {
+		if s == str {
+			return true
+		}
+	}
+	return false
+}
+
 func splitStr(str string) []string {
 	return strings.Split(str, " ")
 }
 
 func writeConf() error {
-	template, err := template.New(filepath.Base(config.Nginx_template)).Funcs(template.FuncMap{
-		"fileExists": fileExists,
-		"splitStr": splitStr,
-	}).ParseFiles(config.Nginx_template)
+	// one consistent view of the paths for the whole write, even if the
+	// config changes while rendering.
+	config.RLock()
+	dir := config.Nginx_config_dir
+	appTemplate := config.Nginx_app_template
+	nginxConfig := config.Nginx_config
+	nginxTemplate := config.Nginx_template
+	config.RUnlock()
+	if dir != "" {
+		return writeConfDir(dir, appTemplate, nginxConfig)
+	}
+	// same directory as the config, so the rename below can't cross filesystems.
+	tmpFile, err := ioutil.TempFile(filepath.Dir(nginxConfig), ".nixy")
 	if err != nil {
 		return err
 	}
+	// a no-op once the file has been renamed into place.
+	defer os.Remove(tmpFile.Name())
 
-	tmpFile, err := ioutil.TempFile("", "nixy")
-	defer tmpFile.Close()
+	err = renderTemplate(nginxTemplate, tmpFile)
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	setUpdated(&config.LastUpdates.LastConfigRendered)
 
-	err = template.Execute(tmpFile, config)
+	err = checkShrink(nginxConfig, tmpFile.Name())
 	if err != nil {
 		return err
 	}
-	config.LastUpdates.LastConfigRendered = time.Now()
 
 	err = checkConf(tmpFile.Name())
+	recordCheck(err)
 	if err != nil {
 		return err
 	}
 
-	err = os.Rename(tmpFile.Name(), config.Nginx_config)
+	err = os.Rename(tmpFile.Name(), nginxConfig)
 	if err != nil {
 		return err
 	}
@@ -384,22 +1331,83 @@ func writeConf() error {
 	return nil
 }
 
-func checkTmpl() error {
-	t, err := template.New(filepath.Base(config.Nginx_template)).Funcs(template.FuncMap{
-		"fileExists": fileExists,
-		"splitStr": splitStr,
-	}).ParseFiles(config.Nginx_template)
+// setUpdated sets one of the config.LastUpdates times to now. They are read
+// by health and the sync watchdog from other goroutines, so under the lock.
+func setUpdated(field *time.Time) {
+	config.Lock()
+	defer config.Unlock()
+	*field = time.Now()
+}
+
+// allowShrink is set by /v1/reload?allow_shrink=true to let the next render
+// through checkShrink, for an intended big scale down.
+var allowShrink int32
+
+// checkShrink refuses a rendered config that is more than max_shrink_percent
+// smaller than the deployed one, which usually means a template bug. Refused
+// renders are never deployed, so they keep being refused until the size
+// recovers or a reload with allow_shrink lets one through.
+func checkShrink(deployed string, path string) error {
+	if config.Max_shrink_percent <= 0 || config.Max_shrink_percent >= 100 {
+		return nil
+	}
+	rendered, err := os.Stat(path)
 	if err != nil {
 		return err
 	}
-	err = t.Execute(ioutil.Discard, config)
+	current, err := os.Stat(deployed)
+	if err != nil || current.Size() == 0 {
+		// nothing deployed yet to compare with.
+		return nil
+	}
+	shrink := (current.Size() - rendered.Size()) * 100 / current.Size()
+	if shrink <= int64(config.Max_shrink_percent) {
+		return nil
+	}
+	if atomic.CompareAndSwapInt32(&allowShrink, 1, 0) {
+		logger.Warningf("rendered config shrunk by %v%%, allowed by the reload request, old size: %v, new size: %v, cluster: %v", shrink, current.Size(), rendered.Size(), clusterName())
+		return nil
+	}
+	logger.Errorf("rendered config shrunk by %v%%, old size: %v, new size: %v, cluster: %v", shrink, current.Size(), rendered.Size(), clusterName())
+	return fmt.Errorf("rendered config shrunk by %v%%, more than the allowed %v%%", shrink, config.Max_shrink_percent)
+}
+
+func checkTmpl() error {
+	if config.Nginx_config_dir != "" {
+		_, err := renderApps(config.Nginx_app_template)
+		return err
+	}
+	err := renderConf(ioutil.Discard)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
+// nginxNotFoundError means nginx_cmd does not point to an executable, which
+// is a problem with the nixy config and not with the template.
+type nginxNotFoundError struct {
+	cmd string
+	err error
+}
+
+func (e nginxNotFoundError) Error() string {
+	return "nginx binary not found, check nginx_cmd: " + e.err.Error()
+}
+
+// lookupNginx resolves nginx_cmd the same way exec does.
+func lookupNginx() error {
+	_, err := exec.LookPath(config.Nginx_cmd)
+	if err != nil {
+		return nginxNotFoundError{cmd: config.Nginx_cmd, err: err}
+	}
+	return nil
+}
+
 func checkConf(path string) error {
+	if err := lookupNginx(); err != nil {
+		return err
+	}
 	cmd := exec.Command(config.Nginx_cmd, "-c", path, "-t")
 	var stderr bytes.Buffer
 	cmd.Stderr = &stderr
@@ -412,40 +1420,301 @@ func checkConf(path string) error {
 	return nil
 }
 
+// readNginxPid reads the pid of the nginx master from nginx_pidfile.
+func readNginxPid() (int, error) {
+	b, err := ioutil.ReadFile(config.Nginx_pidfile)
+	if err != nil {
+		return 0, err
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil || pid < 1 {
+		return 0, fmt.Errorf("pidfile %v does not contain a valid pid", config.Nginx_pidfile)
+	}
+	return pid, nil
+}
+
+// signalNginx reloads nginx by sending SIGHUP to its master process.
+func signalNginx() error {
+	pid, err := readNginxPid()
+	if err != nil {
+		return err
+	}
+	return syscall.Kill(pid, syscall.SIGHUP)
+}
+
+// reloadNginx reloads nginx with SIGHUP when nginx_pidfile is set, nginx -s
+// reload otherwise, retrying either nginx_reload_retries times.
 func reloadNginx() error {
+	reload := runNginxReload
+	if config.Nginx_pidfile != "" {
+		reload = signalNginx
+	} else if err := lookupNginx(); err != nil {
+		return err
+	}
+	var err error
+	for attempt := 0; attempt <= config.Nginx_reload_retries; attempt++ {
+		if attempt > 0 {
+			logger.Warningf("retrying nginx reload, attempt: %v, error: %v, cluster: %v", attempt, err.Error(), clusterName())
+			time.Sleep(1 * time.Second)
+		}
+		err = reload()
+		if err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// runNginxReload runs nginx -s reload.
+func runNginxReload() error {
 	cmd := exec.Command(config.Nginx_cmd, "-s", "reload")
 	var stderr bytes.Buffer
 	cmd.Stderr = &stderr
 	err := cmd.Run() // will wait for command to return
 	if err != nil {
-		msg := fmt.Sprint(err) + ": " + stderr.String()
-		errstd := errors.New(msg)
-		return errstd
+		return errors.New(fmt.Sprint(err) + ": " + stderr.String())
 	}
 	return nil
 }
 
-func reload() error {
-	jsontasks := MarathonTasks{}
-	jsonapps := MarathonApps{}
-	err := fetchApps(&jsontasks, &jsonapps)
+func reload(ctx context.Context) error {
+	apps, err := source.Fetch(ctx)
+	if err != nil {
+		logger.Errorf("unable to sync from %v, error: %v, cluster: %v", config.Source, err.Error(), clusterName())
+		return err
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	err = checkAppCount(apps)
 	if err != nil {
-		logger.Errorf("unable to sync from marathon, error: %v", err.Error())
+		logger.Errorf("refusing suspicious sync from %v, keeping the deployed config, error: %v, cluster: %v", config.Source, err.Error(), clusterName())
+		go statsCount("reload.refused", 1, "source:"+config.Source)
+		return err
+	}
+	if config.Strict_frontends {
+		err = checkFrontends(apps)
+		if err != nil {
+			logger.Errorf("refusing to reload, error: %v, cluster: %v", err.Error(), clusterName())
+			return err
+		}
+	}
+	config.Lock()
+	appChanges = diffApps(config.Apps, apps)
+	config.Apps = apps
+	config.Unlock()
+	appGauges()
+	setUpdated(&config.LastUpdates.LastSync)
+	err = updateNginx()
+	if err != nil && config.Stop_on_target_error {
 		return err
 	}
-	syncApps(&jsontasks, &jsonapps)
-	config.LastUpdates.LastSync = time.Now()
-	err = writeConf()
+	targetsErr := updateTargets()
 	if err != nil {
-		logger.Errorf("unable to generate nginx config, error: %v", err.Error())
 		return err
 	}
-	config.LastUpdates.LastConfigValid = time.Now()
+	return targetsErr
+}
+
+// maxLoggedIds limits the app ids logged per kind of change.
+const maxLoggedIds = 10
+
+// changes of the apps between two syncs, as logged with "config updated".
+type changes struct {
+	Added   []string
+	Removed []string
+	Changed []string
+}
+
+// appChanges of the last sync, set by reload under reloadLock.
+var appChanges changes
+
+// diffApps compares the apps of a sync with the previous ones, an app changed
+// when its backends did.
+func diffApps(previous, apps map[string]App) changes {
+	var c changes
+	for id, app := range apps {
+		old, ok := previous[id]
+		if !ok {
+			c.Added = append(c.Added, id)
+		} else if !reflect.DeepEqual(old.Backends, app.Backends) {
+			c.Changed = append(c.Changed, id)
+		}
+	}
+	for id := range previous {
+		if _, ok := apps[id]; !ok {
+			c.Removed = append(c.Removed, id)
+		}
+	}
+	sort.Strings(c.Added)
+	sort.Strings(c.Removed)
+	sort.Strings(c.Changed)
+	return c
+}
+
+func (c changes) String() string {
+	return fmt.Sprintf("added: %v, removed: %v, changed: %v", loggedIds(c.Added), loggedIds(c.Removed), loggedIds(c.Changed))
+}
+
+// loggedIds is the count followed by at most maxLoggedIds ids.
+func loggedIds(ids []string) string {
+	if len(ids) == 0 {
+		return "0"
+	}
+	if len(ids) > maxLoggedIds {
+		return fmt.Sprintf("%v [%v ...]", len(ids), strings.Join(ids[:maxLoggedIds], " "))
+	}
+	return fmt.Sprintf("%v [%v]", len(ids), strings.Join(ids, " "))
+}
+
+// checkAppCount guards against an api change that decodes into no apps, which
+// would otherwise look like a healthy sync and drop all routes.
+func checkAppCount(apps map[string]App) error {
+	if len(apps) < config.Min_apps {
+		return fmt.Errorf("got %v apps, less than min_apps %v", len(apps), config.Min_apps)
+	}
+	config.RLock()
+	previous := len(config.Apps)
+	config.RUnlock()
+	if len(apps) == 0 && previous > 0 && !config.Allow_empty_sync {
+		return fmt.Errorf("got no apps, the previous sync had %v", previous)
+	}
+	return nil
+}
+
+// checkFrontends returns an error listing the apps with invalid frontends.
+func checkFrontends(apps map[string]App) error {
+	var ids []string
+	for id, app := range apps {
+		for _, frontend := range app.Frontends {
+			if frontend.Type == "error" {
+				ids = append(ids, id)
+				break
+			}
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	sort.Strings(ids)
+	return errors.New("apps with invalid frontends: " + strings.Join(ids, ", "))
+}
+
+// breakerOpen tells whether reloads are stopped after too many failed config
+// checks. Once the cooldown passed a single attempt decides, a failure opens
+// it again right away.
+func breakerOpen() (time.Time, bool) {
+	health.RLock()
+	defer health.RUnlock()
+	b := health.Breaker
+	return b.Until, b.Open && time.Now().Before(b.Until)
+}
+
+// recordCheck updates the breaker with the result of an nginx config check.
+func recordCheck(err error) {
+	if config.Check_failure_limit <= 0 {
+		return
+	}
+	// before the lock, clusterName takes it too.
+	cluster := clusterName()
+	health.Lock()
+	defer health.Unlock()
+	b := &health.Breaker
+	if err == nil {
+		*b = BreakerStatus{}
+		return
+	}
+	b.Failures++
+	if b.Failures >= config.Check_failure_limit {
+		b.Open = true
+		b.Until = time.Now().Add(config.Check_failure_cooldown.Duration)
+		logger.Errorf("nginx config check failed %v times in a row, stopping reloads until %v, cluster: %v", b.Failures, b.Until.Format(time.RFC3339), cluster)
+		go statsCount("nginx.check.breaker", 1)
+	}
+}
+
+func updateNginx() error {
+	if until, open := breakerOpen(); open {
+		return fmt.Errorf("nginx config checks keep failing, reloads stopped until %v", until.Format(time.RFC3339))
+	}
+	// kept for a rollback when the post reload check fails.
+	var previous []byte
+	if config.Post_reload_check_url != "" && config.Nginx_config_dir == "" {
+		previous, _ = ioutil.ReadFile(config.Nginx_config)
+	}
+	err := writeConf()
+	if err != nil {
+		logger.Errorf("unable to generate nginx config, error: %v, cluster: %v", err.Error(), clusterName())
+		return err
+	}
+	setUpdated(&config.LastUpdates.LastConfigValid)
 	err = reloadNginx()
 	if err != nil {
-		logger.Errorf("unable to reload nginx, error: %v", err.Error())
+		logger.Errorf("unable to reload nginx, error: %v, cluster: %v", err.Error(), clusterName())
+		return err
+	}
+	setUpdated(&config.LastUpdates.LastNginxReload)
+	err = postReloadCheck()
+	if err != nil {
+		logger.Errorf("nginx is not serving after the reload, error: %v, url: %v, cluster: %v", err.Error(), config.Post_reload_check_url, clusterName())
+		rollbackNginx(previous)
 		return err
 	}
-	config.LastUpdates.LastNginxReload = time.Now()
 	return nil
 }
+
+// postReloadCheck polls post_reload_check_url until it answers with 200 or
+// post_reload_check_timeout passed, since nginx can accept a reload and then
+// fail to bind or serve.
+func postReloadCheck() error {
+	if config.Post_reload_check_url == "" {
+		return nil
+	}
+	client := &http.Client{Timeout: config.Post_reload_check_timeout.Duration}
+	deadline := time.Now().Add(config.Post_reload_check_timeout.Duration)
+	var err error
+	for {
+		var resp *http.Response
+		resp, err = client.Get(config.Post_reload_check_url)
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == 200 {
+				setPostReload(Status{Healthy: true, Message: "OK"})
+				go statsCount("nginx.reload.verified", 1)
+				return nil
+			}
+			err = errors.New("responded with " + resp.Status)
+		}
+		if time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+	setPostReload(Status{Healthy: false, Message: err.Error()})
+	go statsCount("nginx.reload.verify_failed", 1)
+	return err
+}
+
+func setPostReload(status Status) {
+	health.Lock()
+	defer health.Unlock()
+	health.PostReload = status
+}
+
+// rollbackNginx puts the config from before the failed reload back in place
+// and reloads again. With nginx_config_dir there is nothing kept to go back to.
+func rollbackNginx(previous []byte) {
+	if previous == nil {
+		logger.Errorf("no previous nginx config to roll back to, cluster: %v", clusterName())
+		return
+	}
+	err := writeFileAtomic(config.Nginx_config, previous)
+	if err == nil {
+		err = reloadNginx()
+	}
+	if err != nil {
+		logger.Errorf("unable to roll back the nginx config, error: %v, cluster: %v", err.Error(), clusterName())
+		return
+	}
+	logger.Warningf("rolled back to the previous nginx config, cluster: %v", clusterName())
+}
@@ -0,0 +1,570 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	// tests change single fields of the config, never all of it, stats are
+	// sent from goroutines that outlive the test reading it.
+	setDefaults()
+	eventqueue = make(chan bool, config.Event_queue_size)
+	os.Exit(m.Run())
+}
+
+// setEndpoints marks the given marathon endpoints as the only, healthy ones.
+func setEndpoints(endpoints ...string) {
+	config.Lock()
+	config.Marathon = endpoints
+	config.Unlock()
+	health.Lock()
+	defer health.Unlock()
+	health.Endpoints = nil
+	for _, endpoint := range endpoints {
+		health.Endpoints = append(health.Endpoints, EndpointStatus{Endpoint: endpoint, Healthy: true})
+	}
+	health.Active = ActiveEndpoints{}
+	health.Cluster = ""
+}
+
+// waitForCluster waits for refreshCluster, started in the background when
+// the active endpoint switches, so it doesn't outlive the test.
+func waitForCluster(t *testing.T) {
+	t.Helper()
+	for i := 0; i < 100; i++ {
+		if clusterName() != "" {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("cluster name was never read")
+}
+
+// marathonServer serves fixed apps and tasks responses.
+func marathonServer(apps, tasks string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v2/apps":
+			w.Write([]byte(apps))
+		case "/v2/tasks":
+			w.Write([]byte(tasks))
+		case "/v2/info":
+			w.Write([]byte(`{"name":"test"}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+}
+
+const testApps = `{"apps":[{"id":"/foo","labels":{"subdomain":"foo"},"ports":[10000]}]}`
+const testTasks = `{"tasks":[{"appId":"/foo","host":"10.0.0.1","ports":[31000]}]}`
+
+func TestFetchAppsFailsOver(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+	}{
+		{"error status", func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "leader election", http.StatusInternalServerError)
+		}},
+		{"truncated body", func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`{"apps":[{"id":"/foo","lab`))
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			failing := httptest.NewServer(tt.handler)
+			defer failing.Close()
+			working := marathonServer(testApps, testTasks)
+			defer working.Close()
+			setEndpoints(failing.URL, working.URL)
+
+			var jsontasks MarathonTasks
+			var jsonapps MarathonApps
+			err := fetchApps(context.Background(), &jsontasks, &jsonapps)
+			if err != nil {
+				t.Fatalf("fetchApps failed: %v", err)
+			}
+			if len(jsonapps.Apps) != 1 || jsonapps.Apps[0].Id != "/foo" {
+				t.Errorf("got apps %+v, want /foo from the second endpoint", jsonapps.Apps)
+			}
+			if len(jsontasks.Tasks) != 1 {
+				t.Errorf("got %v tasks, want 1", len(jsontasks.Tasks))
+			}
+			if health.Endpoints[0].Healthy {
+				t.Errorf("failing endpoint is still healthy")
+			}
+			if !health.Endpoints[1].Healthy {
+				t.Errorf("working endpoint was marked unhealthy")
+			}
+			waitForCluster(t)
+			if health.Active.Fetch != working.URL {
+				t.Errorf("active fetch endpoint is %q, want %q", health.Active.Fetch, working.URL)
+			}
+		})
+	}
+}
+
+func TestCheckShrink(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name string, size int) string {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, bytes.Repeat([]byte("x"), size), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	deployed := write("nginx.conf", 1000)
+	defer func(percent int) { config.Max_shrink_percent = percent }(config.Max_shrink_percent)
+	atomic.StoreInt32(&allowShrink, 0)
+
+	config.Max_shrink_percent = 0
+	if err := checkShrink(deployed, write("empty.conf", 10)); err != nil {
+		t.Errorf("disabled guard refused: %v", err)
+	}
+	config.Max_shrink_percent = 50
+	// a broken template renders the same small config on every reload.
+	for i := 0; i < 3; i++ {
+		if err := checkShrink(deployed, write("small.conf", 400)); err == nil {
+			t.Errorf("shrink by 60%% was not refused on render %v", i+1)
+		}
+	}
+	if err := checkShrink(deployed, write("fixed.conf", 900)); err != nil {
+		t.Errorf("render that recovered the size was refused: %v", err)
+	}
+	if err := checkShrink(deployed, write("grown.conf", 1200)); err != nil {
+		t.Errorf("growing config was refused: %v", err)
+	}
+	// reload?allow_shrink=true lets exactly one render through.
+	atomic.StoreInt32(&allowShrink, 1)
+	if err := checkShrink(deployed, write("small.conf", 400)); err != nil {
+		t.Errorf("allowed shrink was refused: %v", err)
+	}
+	if err := checkShrink(deployed, write("small.conf", 400)); err == nil {
+		t.Errorf("shrink was allowed twice")
+	}
+
+}
+
+func TestMarathonURL(t *testing.T) {
+	tests := []struct {
+		endpoint, path, want string
+	}{
+		{"http://marathon:8080", "v2/apps", "http://marathon:8080/v2/apps"},
+		{"http://marathon:8080/", "v2/apps", "http://marathon:8080/v2/apps"},
+		{"https://gw/marathon", "v2/apps", "https://gw/marathon/v2/apps"},
+		{"https://gw/marathon/", "v2/apps", "https://gw/marathon/v2/apps"},
+		{"https://gw/dcos/marathon", "ping", "https://gw/dcos/marathon/ping"},
+		{"https://gw/marathon", "/ping", "https://gw/ping"},
+		{"http://marathon:8080", "/ping", "http://marathon:8080/ping"},
+		{"https://gw/marathon", "v2/groups?embed=group.groups", "https://gw/marathon/v2/groups?embed=group.groups"},
+	}
+	for _, tt := range tests {
+		if got := marathonURL(tt.endpoint, tt.path); got != tt.want {
+			t.Errorf("marathonURL(%q, %q) = %q, want %q", tt.endpoint, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestAPIURL(t *testing.T) {
+	defer func(base string) { config.Marathon_api_base = base }(config.Marathon_api_base)
+	tests := []struct {
+		base, endpoint, want string
+	}{
+		{"/v2", "http://marathon:8080", "http://marathon:8080/v2/apps"},
+		{"/v2", "https://gw/marathon", "https://gw/marathon/v2/apps"},
+		{"v2/", "https://gw/marathon/", "https://gw/marathon/v2/apps"},
+		{"/api/v3", "https://gw/marathon", "https://gw/marathon/api/v3/apps"},
+		{"/", "http://marathon:8080", "http://marathon:8080/apps"},
+	}
+	for _, tt := range tests {
+		config.Marathon_api_base = tt.base
+		if got := apiURL(tt.endpoint, "apps"); got != tt.want {
+			t.Errorf("apiURL(%q, apps) with base %q = %q, want %q", tt.endpoint, tt.base, got, tt.want)
+		}
+	}
+}
+
+// syncJSON runs syncApps on apps and tasks given as marathon json.
+func syncJSON(t *testing.T, apps, tasks string) map[string]App {
+	t.Helper()
+	var jsonapps MarathonApps
+	var jsontasks MarathonTasks
+	if err := json.Unmarshal([]byte(apps), &jsonapps); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal([]byte(tasks), &jsontasks); err != nil {
+		t.Fatal(err)
+	}
+	return syncApps(&jsontasks, &jsonapps)
+}
+
+func TestSyncAppsDeduplicatesBackends(t *testing.T) {
+	apps := syncJSON(t, testApps, `{"tasks":[
+		{"appId":"/foo","host":"10.0.0.1","ports":[31000]},
+		{"appId":"/foo","host":"10.0.0.1","ports":[31000]},
+		{"appId":"/foo","host":"10.0.0.2","ports":[31000]}]}`)
+	foo := apps["/foo"]
+	if want := []string{"10.0.0.1:31000", "10.0.0.2:31000"}; !reflect.DeepEqual(foo.Tasks, [][]string{want}) {
+		t.Errorf("tasks = %v, want %v", foo.Tasks, want)
+	}
+	if len(foo.Backends[0]) != 2 {
+		t.Errorf("got %v backends, want 2", len(foo.Backends[0]))
+	}
+	if foo.HealthyTasks != 3 {
+		t.Errorf("healthy tasks = %v, want all 3 reported tasks", foo.HealthyTasks)
+	}
+}
+
+func TestSyncAppsMixedFrontends(t *testing.T) {
+	apps := syncJSON(t, `{"apps":[{"id":"/db","labels":{"frontends":"db-admin/http 5432/tcp"},"ports":[10000,10001]}]}`,
+		`{"tasks":[{"appId":"/db","host":"10.0.0.1","ports":[31000,31001]}]}`)
+	want := []Frontend{
+		{Type: "http", Data: []string{"db-admin"}, TCP: false},
+		{Type: "tcp", Data: []string{"5432"}, TCP: true},
+	}
+	if got := apps["/db"].Frontends; !reflect.DeepEqual(got, want) {
+		t.Errorf("frontends = %+v, want %+v", got, want)
+	}
+	if got := apps["/db"].Tasks; !reflect.DeepEqual(got, [][]string{{"10.0.0.1:31000"}, {"10.0.0.1:31001"}}) {
+		t.Errorf("tasks = %v, want one backend per port", got)
+	}
+	config.Lock()
+	config.Apps = apps
+	config.Unlock()
+	out, err := render(t, `{{ range $id, $app := .Apps }}{{ range $app.Frontends }}{{ if isTCP . }}stream{{ else }}http{{ end }} {{ end }}{{ end }}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out != "http stream " {
+		t.Errorf("rendered %q, want the http frontend in http and the tcp one in stream", out)
+	}
+}
+
+func TestTCPFrontendPorts(t *testing.T) {
+	for _, frontend := range []string{"0/tcp", "65536/tcp", "80,99999/tcp"} {
+		if _, err := parseFrontend(frontend); err == nil {
+			t.Errorf("%v: invalid port accepted", frontend)
+		}
+	}
+	f, err := parseFrontend("80,443/tcp")
+	if err != nil || !f.TCP {
+		t.Errorf("80,443/tcp: got %+v, %v", f, err)
+	}
+}
+
+func TestExcludeApps(t *testing.T) {
+	server := marathonServer(`{"apps":[
+		{"id":"/internal/noisy-app","ports":[10000]},
+		{"id":"/internal/other","ports":[10000]},
+		{"id":"/tmp/a/b","ports":[10000]},
+		{"id":"/shop/web","ports":[10000]}]}`,
+		`{"tasks":[
+		{"appId":"/internal/noisy-app","host":"10.0.0.1","ports":[31000]},
+		{"appId":"/internal/other","host":"10.0.0.1","ports":[31001]},
+		{"appId":"/tmp/a/b","host":"10.0.0.1","ports":[31002]},
+		{"appId":"/shop/web","host":"10.0.0.1","ports":[31003]}]}`)
+	defer server.Close()
+	setEndpoints(server.URL)
+	defer func(exclude []string) { config.Exclude_apps = exclude }(config.Exclude_apps)
+	// a glob and a prefix ending in *, which unlike the glob spans groups.
+	config.Exclude_apps = []string{"/internal/noisy-*", "/tmp/*"}
+
+	apps, err := marathonSource{}.Fetch(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForCluster(t)
+	for _, id := range []string{"/internal/noisy-app", "/tmp/a/b"} {
+		if _, ok := apps[id]; ok {
+			t.Errorf("excluded app %v was synced", id)
+		}
+	}
+	for _, id := range []string{"/internal/other", "/shop/web"} {
+		if _, ok := apps[id]; !ok {
+			t.Errorf("app %v is missing", id)
+		}
+	}
+	if !excludedApp("/tmp/a/b/c") || excludedApp("/tmpfoo/a") {
+		t.Errorf("prefix /tmp/* should match /tmp/a/b/c but not /tmpfoo/a")
+	}
+	config.Exclude_apps = []string{"/group/*/canary"}
+	if !excludedApp("/group/shop/canary") || excludedApp("/group/shop/web") {
+		t.Errorf("glob /group/*/canary doesn't match as a glob")
+	}
+}
+
+func TestSyncAppsSkipsDrainedTasks(t *testing.T) {
+	apps := syncJSON(t, testApps, `{"tasks":[
+		{"appId":"/foo","host":"10.0.0.1","ports":[31000]},
+		{"appId":"/foo","host":"10.0.0.2","ports":[31000],"labels":{"nixy.drain":"true"}},
+		{"appId":"/foo","host":"10.0.0.3","ports":[31000],"labels":{"nixy.drain":"false"}}]}`)
+	foo := apps["/foo"]
+	if want := [][]string{{"10.0.0.1:31000", "10.0.0.3:31000"}}; !reflect.DeepEqual(foo.Tasks, want) {
+		t.Errorf("tasks = %v, want %v", foo.Tasks, want)
+	}
+	if foo.TotalTasks != 3 || foo.HealthyTasks != 2 {
+		t.Errorf("total %v, healthy %v, want 3 and 2", foo.TotalTasks, foo.HealthyTasks)
+	}
+}
+
+func TestSyncAppsBackupsLast(t *testing.T) {
+	apps := syncJSON(t, testApps, `{"tasks":[
+		{"appId":"/foo","host":"10.0.0.1","ports":[31000],"labels":{"nixy.backup":"true"}},
+		{"appId":"/foo","host":"10.0.0.2","ports":[31000]},
+		{"appId":"/foo","host":"10.0.0.3","ports":[31000],"labels":{"nixy.backup":"true"}},
+		{"appId":"/foo","host":"10.0.0.4","ports":[31000]}]}`)
+	foo := apps["/foo"]
+	var got []string
+	for _, backend := range foo.Backends[0] {
+		if backend.Backup {
+			got = append(got, backend.String()+" backup")
+		} else {
+			got = append(got, backend.String())
+		}
+	}
+	want := []string{"10.0.0.2:31000", "10.0.0.4:31000", "10.0.0.1:31000 backup", "10.0.0.3:31000 backup"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("backends = %v, want %v", got, want)
+	}
+	if want := [][]string{{"10.0.0.2:31000", "10.0.0.4:31000", "10.0.0.1:31000", "10.0.0.3:31000"}}; !reflect.DeepEqual(foo.Tasks, want) {
+		t.Errorf("tasks = %v, want them in the order of the backends %v", foo.Tasks, want)
+	}
+
+	// the app label makes all backends backups, the order stays the same.
+	apps = syncJSON(t, `{"apps":[{"id":"/foo","labels":{"nixy.backup":"true"},"ports":[10000]}]}`, testTasks)
+	if backends := apps["/foo"].Backends[0]; len(backends) != 1 || !backends[0].Backup {
+		t.Errorf("backends = %+v, want a backup from the app label", backends)
+	}
+}
+
+func TestFrontendTypes(t *testing.T) {
+	defer func(allowed, denied []string) {
+		config.Allowed_frontend_types, config.Denied_frontend_types = allowed, denied
+	}(config.Allowed_frontend_types, config.Denied_frontend_types)
+	const label = "web/http shop.example.com/shop dev/shop-dev"
+	tests := []struct {
+		name            string
+		allowed, denied []string
+		want            []string
+	}{
+		{"all", nil, nil, []string{"http", "shop", "shop-dev"}},
+		{"allow", []string{"http", "shop"}, nil, []string{"http", "shop", "error"}},
+		{"deny", nil, []string{"shop-dev"}, []string{"http", "shop", "error"}},
+		{"deny wins", []string{"http", "shop-dev"}, []string{"shop-dev"}, []string{"http", "error", "error"}},
+	}
+	for _, tt := range tests {
+		config.Allowed_frontend_types, config.Denied_frontend_types = tt.allowed, tt.denied
+		frontends := parseFrontends(label, 3)
+		var got []string
+		for _, f := range frontends {
+			got = append(got, f.Type)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%v: got types %v, want %v", tt.name, got, tt.want)
+		}
+		for i, f := range frontends {
+			if f.Type == "error" && !strings.Contains(f.Data[0], "is not allowed") {
+				t.Errorf("%v: frontend %v has error %q", tt.name, i, f.Data[0])
+			}
+		}
+	}
+}
+
+func TestConstraintFilter(t *testing.T) {
+	defer func(filter string, unconstrained bool) {
+		config.Constraint_filter, config.Include_unconstrained = filter, unconstrained
+	}(config.Constraint_filter, config.Include_unconstrained)
+	const apps = `{"apps":[
+		{"id":"/east","ports":[10000],"constraints":[["hostname","UNIQUE"],["region","LIKE","us-east"]]},
+		{"id":"/west","ports":[10000],"constraints":[["region","LIKE","us-west"]]},
+		{"id":"/free","ports":[10000]}]}`
+	const tasks = `{"tasks":[
+		{"appId":"/east","host":"10.0.0.1","ports":[31000]},
+		{"appId":"/west","host":"10.0.0.2","ports":[31000]},
+		{"appId":"/free","host":"10.0.0.3","ports":[31000]}]}`
+	tests := []struct {
+		filter        string
+		unconstrained bool
+		want          []string
+	}{
+		{"", false, []string{"/east", "/free", "/west"}},
+		{"region:LIKE:us-east", false, []string{"/east"}},
+		{"region:LIKE:us-east", true, []string{"/east", "/free"}},
+		{"region:LIKE:eu-central", false, nil},
+		{"region:LIKE:eu-central", true, []string{"/free"}},
+	}
+	for _, tt := range tests {
+		config.Constraint_filter, config.Include_unconstrained = tt.filter, tt.unconstrained
+		var got []string
+		for id := range syncJSON(t, apps, tasks) {
+			got = append(got, id)
+		}
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("filter %q, include_unconstrained %v: got %v, want %v", tt.filter, tt.unconstrained, got, tt.want)
+		}
+	}
+}
+
+func TestDrainBackends(t *testing.T) {
+	defer func(ttl time.Duration, verify, empty bool, apps map[string]App) {
+		config.Drain_ttl.Duration, config.Verify_backends, config.Include_empty_apps = ttl, verify, empty
+		config.Lock()
+		config.Apps = apps
+		config.Unlock()
+	}(config.Drain_ttl.Duration, config.Verify_backends, config.Include_empty_apps, config.Apps)
+	setApps := func(apps map[string]App) {
+		config.Lock()
+		config.Apps = apps
+		config.Unlock()
+	}
+	config.Drain_ttl.Duration = time.Minute
+	config.Include_empty_apps = true
+	const apps = `{"apps":[
+		{"id":"/foo","ports":[10000]},
+		{"id":"/bar","ports":[10000]},
+		{"id":"/baz","ports":[10000]}]}`
+	// nothing listens on port 1, verification leaves that backend out.
+	setApps(syncJSON(t, apps, `{"tasks":[
+		{"appId":"/foo","host":"10.0.0.1","ports":[31000]},
+		{"appId":"/foo","host":"127.0.0.1","ports":[1]},
+		{"appId":"/bar","host":"10.0.0.2","ports":[31000]},
+		{"appId":"/baz","host":"10.0.0.3","ports":[31000]}]}`))
+
+	// /foo loses a task, /bar is removed and /baz is scaled to zero.
+	config.Verify_backends = true
+	synced := syncJSON(t, `{"apps":[{"id":"/foo","ports":[10000]},{"id":"/baz","ports":[10000]}]}`,
+		`{"tasks":[{"appId":"/foo","host":"127.0.0.1","ports":[1]}]}`)
+	config.Verify_backends = false
+	tests := []struct {
+		id   string
+		want []string
+	}{
+		{"/foo", []string{"10.0.0.1:31000"}},
+		{"/bar", []string{"10.0.0.2:31000"}},
+		{"/baz", []string{"10.0.0.3:31000"}},
+	}
+	for _, tt := range tests {
+		a, ok := synced[tt.id]
+		if !ok {
+			t.Errorf("%v: app is gone before its backends drained", tt.id)
+			continue
+		}
+		if len(a.Tasks) != 1 || len(a.Tasks[0]) != 0 {
+			t.Errorf("%v: tasks = %v, want none", tt.id, a.Tasks)
+		}
+		var draining []string
+		for _, backend := range a.Backends[0] {
+			if !backend.Draining {
+				t.Errorf("%v: backend %v is not draining", tt.id, backend.String())
+			}
+			draining = append(draining, backend.String())
+		}
+		if !reflect.DeepEqual(draining, tt.want) {
+			t.Errorf("%v: draining %v, want %v", tt.id, draining, tt.want)
+		}
+	}
+
+	// once drain_ttl passed the removed app goes away, the empty one stays.
+	setApps(synced)
+	config.Drain_ttl.Duration = time.Nanosecond
+	synced = syncJSON(t, `{"apps":[{"id":"/baz","ports":[10000]}]}`, `{"tasks":[]}`)
+	if _, ok := synced["/bar"]; ok {
+		t.Errorf("removed app is kept after drain_ttl")
+	}
+	if baz, ok := synced["/baz"]; !ok || hasBackends(baz) || len(baz.Backends) != 0 {
+		t.Errorf("app scaled to zero = %+v, want it without backends", baz)
+	}
+}
+
+func TestVerifyBackends(t *testing.T) {
+	defer func(verify, keep, empty bool, apps map[string]App) {
+		config.Verify_backends, config.Keep_last_good, config.Include_empty_apps = verify, keep, empty
+		config.Lock()
+		config.Apps = apps
+		config.Unlock()
+	}(config.Verify_backends, config.Keep_last_good, config.Include_empty_apps, config.Apps)
+	const apps = `{"apps":[{"id":"/foo","ports":[10000]},{"id":"/bar","ports":[10000]}]}`
+	// nothing listens on port 1, verification leaves those backends out.
+	config.Keep_last_good = true
+	config.Include_empty_apps = false
+	deployed := syncJSON(t, apps, `{"tasks":[{"appId":"/foo","host":"127.0.0.1","ports":[1]}]}`)
+	config.Lock()
+	config.Apps = deployed
+	config.Unlock()
+
+	// /foo lost its tasks and keeps its last good backend, /bar has only
+	// an unreachable one.
+	config.Verify_backends = true
+	synced := syncJSON(t, apps, `{"tasks":[{"appId":"/bar","host":"127.0.0.1","ports":[1]}]}`)
+	want := [][]string{{"127.0.0.1:1"}}
+	if foo := synced["/foo"]; !foo.LastGood || !reflect.DeepEqual(foo.Tasks, want) {
+		t.Errorf("last good app = %+v, want it with tasks %v", foo, want)
+	}
+	if !reflect.DeepEqual(deployed["/foo"].Tasks, want) || len(deployed["/foo"].Backends[0]) != 1 {
+		t.Errorf("verification changed the deployed app to %+v", deployed["/foo"])
+	}
+	if bar, ok := synced["/bar"]; ok {
+		t.Errorf("app without reachable backends = %+v, want it left out", bar)
+	}
+
+	config.Include_empty_apps = true
+	synced = syncJSON(t, apps, `{"tasks":[{"appId":"/bar","host":"127.0.0.1","ports":[1]}]}`)
+	if bar, ok := synced["/bar"]; !ok || !reflect.DeepEqual(bar.Tasks, [][]string{{}}) {
+		t.Errorf("app without reachable backends = %+v, want it kept empty with include_empty_apps", bar)
+	}
+}
+
+func TestSignalNginxRetries(t *testing.T) {
+	defer func(pidfile string, retries int) {
+		config.Nginx_pidfile, config.Nginx_reload_retries = pidfile, retries
+	}(config.Nginx_pidfile, config.Nginx_reload_retries)
+	// a child stands in for the nginx master, SIGHUP ends it.
+	child := exec.Command("sleep", "10")
+	if err := child.Start(); err != nil {
+		t.Skip("no sleep to signal:", err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- child.Wait() }()
+	defer child.Process.Kill()
+
+	// nginx is restarting, its pidfile is empty until the first retry.
+	pidfile := filepath.Join(t.TempDir(), "nginx.pid")
+	config.Nginx_pidfile = pidfile
+	if err := ioutil.WriteFile(pidfile, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	config.Nginx_reload_retries = 0
+	if err := reloadNginx(); err == nil {
+		t.Fatalf("reload with an empty pidfile succeeded")
+	}
+	config.Nginx_reload_retries = 1
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		ioutil.WriteFile(pidfile, []byte(strconv.Itoa(child.Process.Pid)+"\n"), 0644)
+	}()
+	if err := reloadNginx(); err != nil {
+		t.Fatalf("reload wasn't retried: %v", err)
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Errorf("nginx master didn't get a SIGHUP")
+	}
+}
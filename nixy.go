@@ -1,45 +1,299 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
 	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 	"github.com/BurntSushi/toml"
 	"github.com/gorilla/mux"
-	"github.com/peterbourgon/g2s"
 	"github.com/zooplus/golang-logging"
 )
 
+// Frontend is parsed from the frontends label. TCP frontends carry ports in
+// Data and belong in a stream block, all other types are http.
 type Frontend struct {
 	Type string
 	Data []string
+	TCP  bool
 }
 
+// Backend is a single task port. ContainerPort is only set for bridged docker apps.
+type Backend struct {
+	Host          string
+	HostPort      int64
+	ContainerPort int64
+	Weight        int
+	// empty when marathon doesn't report the fault domain of the agent.
+	Region string
+	Zone   string
+	// rendered with nginx's backup flag, from the nixy.backup app or task label.
+	Backup bool
+	// the task is gone and the backend is kept for drain_ttl, render it as down.
+	// Draining backends are not in Tasks.
+	Draining bool
+
+	// start of the task, zero if marathon didn't report a valid one.
+	startedAt time.Time
+	// when a Draining backend was first missing from a sync.
+	removedAt time.Time
+}
+
+func (b Backend) String() string {
+	return b.Host + ":" + strconv.FormatInt(b.HostPort, 10)
+}
+
+// App holds the backends per port index, both as plain host:port strings in
+// Tasks and with all details in Backends.
 type App struct {
 	Tasks     [][]string
+	Backends  [][]Backend
 	Frontends []Frontend
 	Labels    map[string]string
 	Env       map[string]string
+	// problems found in the labels of the app.
+	Errors []string
+	// upstream keepalive connections from the nixy.keepalive label, nil
+	// when the label is not set.
+	Keepalive *int `json:",omitempty"`
+	// valid names from the space separated nixy.server_name label.
+	ServerNames []string
+	// the app has no healthy tasks and these are its last known good
+	// backends, see keep_last_good.
+	LastGood bool
+	// tasks reported for the app, the ones routed to and the instances it
+	// is scaled to, to tell partially available apps apart.
+	TotalTasks          int
+	HealthyTasks        int
+	ConfiguredInstances int
+
+	// backend weight per port index from the nixy.weight label.
+	weights []int
+	// when the app lost its last healthy task, set while LastGood.
+	unhealthySince time.Time
 }
 
 type Config struct {
 	sync.RWMutex
 	Xproxy         string
+	Source         string   `json:"-"`
 	Port           string   `json:"-"`
 	Marathon       []string `json:"-"`
 	User           string   `json:"-"`
 	Pass           string   `json:"-"`
+	Auth_token     string   `json:"-"`
+	User_agent     string   `json:"-"`
 	Nginx_config   string   `json:"-"`
 	Nginx_template string   `json:"-"`
 	Nginx_cmd      string   `json:"-"`
+	Nginx_pidfile  string   `json:"-"`
 	Statsd         StatsdConfig
+	Consul         ConsulConfig `json:"-"`
 	LastUpdates    Updates
 	Apps           map[string]App
+
+	// toml file with user, pass and auth_token, re-read on SIGHUP.
+	Credentials_file string `json:"-"`
+
+	// free form name like prod, for {{ if eq .Environment "prod" }} in templates.
+	Environment string
+
+	// upstreams outside of marathon by name, each a list of host:port.
+	// templates range over them sorted by name.
+	Static_upstreams map[string][]string
+
+	// render nginx_app_template per app into nginx_config_dir instead of
+	// nginx_template into nginx_config, which then only has to include the dir.
+	Nginx_config_dir   string `json:"-"`
+	Nginx_app_template string `json:"-"`
+
+	// connect timeout covers dialing a marathon node, request timeout the whole request.
+	Marathon_connect_timeout Duration `json:"-"`
+	Marathon_request_timeout Duration `json:"-"`
+
+	// connection pooling of the marathon transport, 0 keeps the go defaults.
+	Transport_max_idle_conns          int      `json:"-"`
+	Transport_max_idle_conns_per_host int      `json:"-"`
+	Transport_idle_conn_timeout       Duration `json:"-"`
+	// never negotiate HTTP/2, the event stream can misbehave over it.
+	Transport_force_http1 bool `json:"-"`
+
+	// random delay before the first and each following endpoint health check, off by default.
+	Health_check_jitter Duration `json:"-"`
+
+	// consecutive successful or failed checks before an endpoint turns healthy or unhealthy.
+	Health_check_rises int `json:"-"`
+	Health_check_falls int `json:"-"`
+
+	// wait this long for an endpoint to recover before failing a reload
+	// because all are down, off by default.
+	Endpoint_wait Duration `json:"-"`
+
+	// which healthy endpoint fetches go to: first, round-robin or random. The
+	// event stream always stays on the first one.
+	Endpoint_strategy string `json:"-"`
+
+	// relative to the marathon endpoint, start with / to ping the root of the host.
+	Marathon_ping_path string `json:"-"`
+
+	// version prefix of the apps, tasks, groups, events and info requests,
+	// always under the marathon endpoint, leading and trailing slashes don't matter.
+	Marathon_api_base string `json:"-"`
+
+	// query strings of the apps and tasks requests to trim the payload, like
+	// embed=apps.tasks. they must keep id, labels, env, ports and health checks.
+	Apps_query  string `json:"-"`
+	Tasks_query string `json:"-"`
+
+	// Accept header of the apps, tasks and info requests, for marathon compatible apis.
+	Marathon_accept      string `json:"-"`
+	Marathon_api_version string `json:"-"`
+
+	// static headers added to every request sent to marathon.
+	Marathon_headers map[string]string `json:"-"`
+
+	// keep apps without any running or healthy tasks, with an empty Tasks list.
+	Include_empty_apps bool `json:"-"`
+
+	// app ids never routed, globs or prefixes ending in *.
+	Exclude_apps []string `json:"-"`
+
+	// merge the labels of the parent groups into every app, from /v2/groups.
+	// labels of the app and of deeper groups win.
+	Inherit_group_labels bool `json:"-"`
+
+	// order of the backends per port: marathon (as reported), host (by
+	// host:port) or started (oldest task first).
+	Backend_order string `json:"-"`
+
+	// only route apps with this constraint, field:operator:value like
+	// region:LIKE:us-east. apps without constraints only with include_unconstrained.
+	Constraint_filter     string `json:"-"`
+	Include_unconstrained bool   `json:"-"`
+
+	// only route apps whose nixy.color label matches, apps without the label are always routed.
+	Active_color   string   `json:"-"`
+	Allowed_colors []string `json:"-"`
+
+	// check on startup that all marathon endpoints belong to the same cluster.
+	Verify_cluster bool `json:"-"`
+
+	// fetch the apps once on startup to catch bad credentials early, on by default.
+	Startup_check bool `json:"-"`
+
+	// env variable read for frontends when an app has no frontends label.
+	Frontends_env string `json:"-"`
+
+	// frontend types this instance routes, any if allowed is empty. Other
+	// frontends become errors.
+	Allowed_frontend_types []string `json:"-"`
+	Denied_frontend_types  []string `json:"-"`
+
+	// fail the reload and keep the deployed config when any app has an invalid frontend.
+	Strict_frontends bool `json:"-"`
+
+	Event_queue_size int `json:"-"`
+
+	// refuse to deploy a config that shrunk more than this compared to the
+	// previous render, 0 or 100 disable the check.
+	Max_shrink_percent int `json:"-"`
+
+	// refuse a sync with fewer apps than min_apps, or with no apps at all after
+	// one that had apps unless allow_empty_sync is set.
+	Min_apps         int  `json:"-"`
+	Allow_empty_sync bool `json:"-"`
+
+	// /v1/health turns unhealthy when the last successful sync is older than
+	// this, 0 disables. stale_sync_reload also queues a reload then.
+	Max_sync_age      Duration `json:"-"`
+	Stale_sync_reload bool     `json:"-"`
+
+	// time allowed to connect to the event stream and between two events on it.
+	// marathon sends a keepalive about every 10s, so it has to be longer than
+	// that or idle streams get cancelled and reconnected all the time.
+	Event_stream_timeout Duration `json:"-"`
+
+	// /v1/health turns unhealthy when the event stream is down longer than this, negative disables.
+	Event_stream_max_down Duration `json:"-"`
+
+	// extra configs rendered from the same apps, each with its own check and reload.
+	Targets              []Target `json:"-"`
+	Stop_on_target_error bool     `json:"-"`
+
+	// abort a reload taking longer than this, 0 means no timeout.
+	Reload_timeout Duration `json:"-"`
+
+	// dial every backend and leave out the ones not accepting connections.
+	Verify_backends         bool     `json:"-"`
+	Verify_backends_timeout Duration `json:"-"`
+
+	// how long SRV lookups of the nixy.srv label are cached.
+	Srv_cache_ttl Duration `json:"-"`
+
+	// keep serving the last backends of an app that lost all healthy tasks
+	// for up to keep_last_good_ttl, instead of dropping it right away.
+	Keep_last_good     bool     `json:"-"`
+	Keep_last_good_ttl Duration `json:"-"`
+
+	// keep backends of removed tasks as Draining for this long, so templates
+	// can render them as down. 0 removes them right away.
+	Drain_ttl Duration `json:"-"`
+
+	// requests per minute and client allowed on /v1/reload, 0 means no limit.
+	Reload_api_rate int `json:"-"`
+
+	// post the outcome of every reload here, or only failures with webhook_on = "failure".
+	Webhook_url string `json:"-"`
+	Webhook_on  string `json:"-"`
+
+	// lines of nginx -t output shown in /v1/health, 0 shows all. The full
+	// output is logged either way.
+	Health_error_lines int `json:"-"`
+
+	// stop reloading for check_failure_cooldown after this many nginx config
+	// checks failed in a row, 0 disables.
+	Check_failure_limit    int      `json:"-"`
+	Check_failure_cooldown Duration `json:"-"`
+
+	// url that has to answer with 200 after an nginx reload, otherwise the
+	// previous config is put back.
+	Post_reload_check_url     string   `json:"-"`
+	Post_reload_check_timeout Duration `json:"-"`
+
+	// extra attempts at nginx -s reload, one second apart.
+	Nginx_reload_retries int `json:"-"`
+}
+
+// Duration lets time.Duration values be written as strings like "5s" in the toml config.
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	var err error
+	d.Duration, err = time.ParseDuration(string(text))
+	return err
+}
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
 }
 
 type Updates struct {
@@ -49,149 +303,1000 @@ type Updates struct {
 	LastNginxReload    	time.Time
 }
 
+// UpdateAges is the time since each of Updates, zero if it never happened.
+type UpdateAges struct {
+	LastSync           Duration
+	LastConfigRendered Duration
+	LastConfigValid    Duration
+	LastNginxReload    Duration
+}
+
+func (u Updates) ages() UpdateAges {
+	age := func(t time.Time) Duration {
+		if t.IsZero() {
+			return Duration{}
+		}
+		return Duration{time.Since(t)}
+	}
+	return UpdateAges{
+		LastSync:           age(u.LastSync),
+		LastConfigRendered: age(u.LastConfigRendered),
+		LastConfigValid:    age(u.LastConfigValid),
+		LastNginxReload:    age(u.LastNginxReload),
+	}
+}
+
+type ConsulConfig struct {
+	Addr       string
+	Token      string
+	Datacenter string
+}
+
 type StatsdConfig struct {
 	Addr       string
 	Namespace  string
 	SampleRate int `toml:"sample_rate"`
+	Dogstatsd  bool
+
+	// per metric sample rates, overriding sample_rate.
+	Sample_rates map[string]int
+
+	// tells instances sharing a namespace apart, a name prefix after the
+	// namespace for statsd and an instance tag for dogstatsd.
+	Instance_tag string
+
+	// more backends every metric is also sent to, besides addr.
+	Backends []StatsdBackend
+}
+
+type StatsdBackend struct {
+	Addr      string
+	Dogstatsd bool
 }
 
 type Status struct {
 	Healthy bool
 	Message string
+	// file:line nginx -t complained about, when it names one.
+	Line string `json:",omitempty"`
 }
 
 type EndpointStatus struct {
 	Endpoint string
 	Healthy  bool
 	Message  string
+	// consecutive checks that disagree with Healthy, reset when it flips.
+	Rises int
+	Falls int
+}
+
+type EventStreamStatus struct {
+	Healthy           bool
+	Message           string
+	Connected         bool
+	LastConnect       time.Time
+	DisconnectedSince time.Time
+	Reconnects        int
+}
+
+// ActiveEndpoints are the marathon endpoints the event stream and the last
+// successful fetch used.
+type ActiveEndpoints struct {
+	EventStream string
+	Fetch       string
+	// last time either of them changed.
+	LastSwitch time.Time
+}
+
+// BreakerStatus counts consecutive failed nginx config checks, once
+// check_failure_limit is reached reloads stop until Until.
+type BreakerStatus struct {
+	Open     bool
+	Failures int
+	Until    time.Time
+}
+
+// PauseStatus is set through /v1/pause, a zero Until means no auto-resume.
+type PauseStatus struct {
+	Paused bool
+	Since  time.Time
+	Until  time.Time
+	// events skipped during the pause, one reload catches up on resume.
+	Skipped int
 }
 
 type Health struct {
-	Config    Status
-	Template  Status
-	Endpoints []EndpointStatus
+	sync.RWMutex
+	// Ready is set after the first successful reload.
+	Ready       bool
+	ActiveColor string
+	Pause       PauseStatus
+	Config      Status
+	Template    Status
+	Nginx       Status
+	Sync        Status
+	Breaker     BreakerStatus
+	EventStream EventStreamStatus
+	Endpoints   []EndpointStatus
+	Active      ActiveEndpoints
+	LastUpdates Updates
+	Ages        UpdateAges
+
+	// result of post_reload_check_url after the last nginx reload.
+	PostReload Status
+	// whether the most recent reload succeeded.
+	LastReloadOk bool
+	// name of the marathon cluster, or its framework id when it has none.
+	Cluster string
 }
 
 // Global variables
 var VERSION string //added by goxc
 var config Config
-var statsd g2s.Statter
 var health Health
+var source Source
 
 var logger = logging.New()
 
-// Eventqueue with buffer of two, because we dont really need more.
-var eventqueue = make(chan bool, 2)
+// Eventqueue, buffer size is set by event_queue_size and defaults to two
+// because reloads are coalesced anyway and we dont really need more.
+var eventqueue chan bool
 
 // Global http transport for connection reuse
 var tr = &http.Transport{}
 
-func newHealth() Health {
-	var h Health
+func initHealth() {
+	health.Lock()
+	defer health.Unlock()
+	health.Endpoints = nil
+	health.EventStream.Healthy = true
+	health.EventStream.Message = "OK"
+	health.EventStream.DisconnectedSince = time.Now()
 	for _, ep := range config.Marathon {
 		var s EndpointStatus
 		s.Endpoint = ep
 		s.Healthy = true
 		s.Message = "OK"
-		h.Endpoints = append(h.Endpoints, s)
+		health.Endpoints = append(health.Endpoints, s)
+	}
+}
+
+// validateStaticUpstreams checks that every static upstream server is a host:port.
+func validateStaticUpstreams() error {
+	for name, servers := range config.Static_upstreams {
+		if len(servers) == 0 {
+			return fmt.Errorf("static upstream %v has no servers", name)
+		}
+		for _, server := range servers {
+			host, port, err := net.SplitHostPort(server)
+			if err != nil || host == "" {
+				return fmt.Errorf("static upstream %v has an invalid server %v, expected host:port", name, server)
+			}
+			if p, err := strconv.Atoi(port); err != nil || p < 1 || p > 65535 {
+				return fmt.Errorf("static upstream %v has an invalid port in %v", name, server)
+			}
+		}
+	}
+	return nil
+}
+
+// Credentials is the content of credentials_file.
+type Credentials struct {
+	User       string
+	Pass       string
+	Auth_token string
+}
+
+// applyCredentials overrides the marathon credentials with credentials_file
+// and then the environment. It runs on startup and again on SIGHUP, so
+// rotated credentials are picked up without a restart.
+func applyCredentials() error {
+	var creds Credentials
+	config.RLock()
+	file := config.Credentials_file
+	config.RUnlock()
+	if file != "" {
+		_, err := toml.DecodeFile(file, &creds)
+		if err != nil {
+			return err
+		}
+	}
+	if user := os.Getenv("NIXY_USER"); user != "" {
+		creds.User = user
+	}
+	if pass := os.Getenv("NIXY_PASS"); pass != "" {
+		creds.Pass = pass
+	}
+	if token := os.Getenv("NIXY_AUTH_TOKEN"); token != "" {
+		creds.Auth_token = token
+	}
+	config.Lock()
+	defer config.Unlock()
+	if creds.User != "" {
+		config.User = creds.User
+	}
+	if creds.Pass != "" {
+		config.Pass = creds.Pass
+	}
+	if creds.Auth_token != "" {
+		config.Auth_token = creds.Auth_token
+	}
+	return nil
+}
+
+// watchHangups re-reads the credentials on every SIGHUP.
+func watchHangups() {
+	hups := make(chan os.Signal, 1)
+	signal.Notify(hups, syscall.SIGHUP)
+	go func() {
+		for range hups {
+			config.RLock()
+			file := config.Credentials_file
+			config.RUnlock()
+			err := applyCredentials()
+			if err != nil {
+				logger.Errorf("unable to reload credentials, error: %v, file: %v", err.Error(), file)
+				continue
+			}
+			logger.Infof("credentials reloaded, file: %v", file)
+		}
+	}()
+}
+
+var envRegexp = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// expandEnv replaces ${ENV_VAR} references in all decoded string values of
+// v, including the ones in lists, maps and tables. It runs after decoding so
+// whatever the environment holds ends up as the value and never as toml.
+func expandEnv(v reflect.Value) {
+	switch v.Kind() {
+	case reflect.String:
+		if v.CanSet() {
+			v.SetString(envRegexp.ReplaceAllStringFunc(v.String(), func(ref string) string {
+				return os.Getenv(ref[2 : len(ref)-1])
+			}))
+		}
+	case reflect.Ptr:
+		if !v.IsNil() {
+			expandEnv(v.Elem())
+		}
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if v.Type().Field(i).PkgPath == "" {
+				expandEnv(v.Field(i))
+			}
+		}
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			expandEnv(v.Index(i))
+		}
+	case reflect.Map:
+		for _, key := range v.MapKeys() {
+			// map values aren't addressable, expand a copy and put it back.
+			value := reflect.New(v.Type().Elem()).Elem()
+			value.Set(v.MapIndex(key))
+			expandEnv(value)
+			v.SetMapIndex(key, value)
+		}
+	}
+}
+
+// loadConfig reads the toml config. Values are taken in this order, the first
+// one set wins: NIXY_USER, NIXY_PASS and NIXY_AUTH_TOKEN from the environment,
+// credentials_file, the toml file with ${ENV_VAR} references expanded, the
+// defaults.
+func loadConfig(path string) error {
+	file, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	// defaults that are on, toml only overwrites the keys set in the file.
+	config.Startup_check = true
+	// 0 is a valid count, no retries.
+	config.Nginx_reload_retries = 1
+	err = toml.Unmarshal(file, &config)
+	if err != nil {
+		return err
+	}
+	expandEnv(reflect.ValueOf(&config).Elem())
+	err = applyCredentials()
+	if err != nil {
+		return err
+	}
+	setDefaults()
+	err = validateStaticUpstreams()
+	if err != nil {
+		return err
+	}
+	for name, query := range map[string]string{"apps_query": config.Apps_query, "tasks_query": config.Tasks_query} {
+		if _, err := url.ParseQuery(query); err != nil {
+			return fmt.Errorf("%v %q is not a valid query string, error: %v", name, query, err)
+		}
+	}
+	switch config.Backend_order {
+	case "marathon", "host", "started":
+	default:
+		return fmt.Errorf("backend_order %v is not one of marathon, host or started", config.Backend_order)
+	}
+	switch config.Endpoint_strategy {
+	case "first", "round-robin", "random":
+	default:
+		return fmt.Errorf("endpoint_strategy %v is not one of first, round-robin or random", config.Endpoint_strategy)
+	}
+	if config.Event_stream_timeout.Duration <= 10*time.Second {
+		return fmt.Errorf("event_stream_timeout %v has to be longer than the 10s keepalive interval of marathon", config.Event_stream_timeout)
+	}
+	return nil
+}
+
+func setDefaults() {
+	if config.Source == "" {
+		config.Source = "marathon"
+	}
+	if config.User_agent == "" {
+		config.User_agent = "nixy/" + VERSION
+	}
+	if config.Consul.Addr == "" {
+		config.Consul.Addr = "http://localhost:8500"
+	}
+	if config.Marathon_connect_timeout.Duration <= 0 {
+		config.Marathon_connect_timeout.Duration = 5 * time.Second
+	}
+	if config.Marathon_request_timeout.Duration <= 0 {
+		config.Marathon_request_timeout.Duration = 5 * time.Second
+	}
+	if config.Marathon_accept == "" {
+		config.Marathon_accept = "application/json"
+	}
+	if config.Marathon_ping_path == "" {
+		config.Marathon_ping_path = "ping"
+	}
+	if config.Marathon_api_base == "" {
+		config.Marathon_api_base = "/v2"
+	}
+	if config.Event_stream_max_down.Duration == 0 {
+		config.Event_stream_max_down.Duration = 1 * time.Minute
+	}
+	if config.Event_queue_size < 1 {
+		config.Event_queue_size = 2
+	}
+	if config.Nginx_reload_retries < 0 {
+		config.Nginx_reload_retries = 1
+	}
+	if config.Health_check_rises <= 0 {
+		config.Health_check_rises = 1
+	}
+	if config.Health_check_falls <= 0 {
+		config.Health_check_falls = 1
+	}
+	if config.Event_stream_timeout.Duration <= 0 {
+		config.Event_stream_timeout.Duration = 15 * time.Second
+	}
+	if config.Backend_order == "" {
+		config.Backend_order = "marathon"
+	}
+	if config.Endpoint_strategy == "" {
+		config.Endpoint_strategy = "first"
+	}
+	if config.Post_reload_check_timeout.Duration <= 0 {
+		config.Post_reload_check_timeout.Duration = 5 * time.Second
+	}
+	if config.Verify_backends_timeout.Duration <= 0 {
+		config.Verify_backends_timeout.Duration = 1 * time.Second
+	}
+	if config.Srv_cache_ttl.Duration <= 0 {
+		config.Srv_cache_ttl.Duration = 30 * time.Second
+	}
+	if config.Check_failure_cooldown.Duration <= 0 {
+		config.Check_failure_cooldown.Duration = 1 * time.Minute
+	}
+	if config.Keep_last_good_ttl.Duration <= 0 {
+		config.Keep_last_good_ttl.Duration = 5 * time.Minute
+	}
+}
+
+// setupTransport applies the marathon transport settings of the config to tr.
+func setupTransport(tr *http.Transport) {
+	tr.DialContext = (&net.Dialer{
+		Timeout: config.Marathon_connect_timeout.Duration,
+	}).DialContext
+	tr.ResponseHeaderTimeout = config.Marathon_request_timeout.Duration
+	tr.MaxIdleConns = config.Transport_max_idle_conns
+	tr.MaxIdleConnsPerHost = config.Transport_max_idle_conns_per_host
+	tr.IdleConnTimeout = config.Transport_idle_conn_timeout.Duration
+	// a custom DialContext turns off HTTP/2 unless it is forced back on.
+	tr.ForceAttemptHTTP2 = !config.Transport_force_http1
+	if config.Transport_force_http1 {
+		// a non-nil empty map disables the HTTP/2 upgrade over TLS.
+		tr.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
 	}
-	return h
 }
 
 func nixy_reload(w http.ResponseWriter, r *http.Request) {
+	if !reloadLimits.allow(clientAddr(r)) {
+		logger.Warningf("reload rate limit exceeded, client: %v", r.RemoteAddr)
+		w.WriteHeader(http.StatusTooManyRequests)
+		fmt.Fprintln(w, "too many reloads")
+		return
+	}
 
 	logger.Infof("marathon reload triggered, client: %v", r.RemoteAddr)
+	if r.URL.Query().Get("allow_shrink") == "true" {
+		logger.Warningf("next config may shrink more than max_shrink_percent, client: %v", r.RemoteAddr)
+		atomic.StoreInt32(&allowShrink, 1)
+	}
 
-	select {
-	case eventqueue <- true: // Add reload to our queue channel, unless it is full of course.
-		w.WriteHeader(202)
+	w.WriteHeader(202)
+	if queueReload() {
 		fmt.Fprintln(w, "queued")
-		return
-	default:
-		w.WriteHeader(202)
+	} else {
 		fmt.Fprintln(w, "queue is full")
+	}
+}
+
+// nixy_pause stops reloads until /v1/resume is called or the optional
+// ?duration=10m has passed.
+func nixy_pause(w http.ResponseWriter, r *http.Request) {
+	var duration time.Duration
+	if d := r.URL.Query().Get("duration"); d != "" {
+		var err error
+		duration, err = time.ParseDuration(d)
+		if err != nil || duration <= 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintln(w, "invalid duration")
+			return
+		}
+	}
+	health.Lock()
+	health.Pause = PauseStatus{Paused: true, Since: time.Now(), Skipped: health.Pause.Skipped}
+	if duration > 0 {
+		health.Pause.Until = health.Pause.Since.Add(duration)
+		// expire the pause on time even when no events come in to notice it.
+		time.AfterFunc(duration, func() { paused() })
+	}
+	health.Unlock()
+	logger.Infof("reloads paused, duration: %v, client: %v", duration, r.RemoteAddr)
+	fmt.Fprintln(w, "paused")
+}
+
+func nixy_resume(w http.ResponseWriter, r *http.Request) {
+	health.Lock()
+	skipped := health.Pause.Skipped
+	health.Pause = PauseStatus{}
+	health.Unlock()
+	logger.Infof("reloads resumed, skipped events: %v, client: %v", skipped, r.RemoteAddr)
+	catchUp(skipped)
+	fmt.Fprintln(w, "resumed")
+}
+
+// nixy_color switches the active blue/green color, taken from a json body
+// like {"color":"green"} or ?color=green, and queues a reload.
+func nixy_color(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Color string `json:"color"`
+	}
+	body.Color = r.URL.Query().Get("color")
+	if body.Color == "" {
+		err := json.NewDecoder(r.Body).Decode(&body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintln(w, "invalid body, expected {\"color\":\"<color>\"}")
+			return
+		}
+	}
+	if body.Color == "" || (len(config.Allowed_colors) > 0 && !containsStr(config.Allowed_colors, body.Color)) {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "color %q is not allowed\n", body.Color)
 		return
 	}
+	config.Lock()
+	previous := config.Active_color
+	config.Active_color = body.Color
+	config.Unlock()
+	logger.Infof("active color switched, previous: %v, color: %v, client: %v", previous, body.Color, r.RemoteAddr)
+	queueReload()
+	w.Header().Add("Content-Type", "application/json; charset=utf-8")
+	b, _ := json.MarshalIndent(map[string]string{"Previous": previous, "Color": body.Color}, "", "  ")
+	w.Write(b)
+}
+
+func nixy_frontend_disable(w http.ResponseWriter, r *http.Request) {
+	setFrontend(w, r, true)
+}
+
+func nixy_frontend_enable(w http.ResponseWriter, r *http.Request) {
+	setFrontend(w, r, false)
+}
+
+// setFrontend takes a frontend as written in the frontends label out of
+// rotation or puts it back, for all apps that have it.
+func setFrontend(w http.ResponseWriter, r *http.Request, disabled bool) {
+	var body struct {
+		Frontend string `json:"frontend"`
+	}
+	body.Frontend = r.URL.Query().Get("frontend")
+	if body.Frontend == "" {
+		err := json.NewDecoder(r.Body).Decode(&body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintln(w, "invalid body, expected {\"frontend\":\"<frontend>\"}")
+			return
+		}
+	}
+	f, err := parseFrontend(strings.TrimSpace(body.Frontend))
+	if err != nil && err != errFrontendNotAllowed {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintln(w, err.Error())
+		return
+	}
+	id := frontendId(f)
+	if disabledFrontends.set(id, disabled) {
+		logger.Infof("frontend disabled: %v, frontend: %v, client: %v", disabled, id, r.RemoteAddr)
+		queueReload()
+	}
+	w.Header().Add("Content-Type", "application/json; charset=utf-8")
+	b, _ := json.MarshalIndent(map[string]interface{}{"Frontend": id, "Disabled": disabled, "DisabledFrontends": disabledFrontends.list()}, "", "  ")
+	w.Write(b)
+}
+
+// FrontendResult is the outcome of /v1/validate-frontend for one frontend.
+type FrontendResult struct {
+	Frontend string
+	Valid    bool
+	Parsed   *Frontend `json:",omitempty"`
+	Error    string    `json:",omitempty"`
 }
 
+// nixy_validate_frontend checks a frontends label before it is deployed, with
+// the same code syncApps uses, and reports every frontend on its own.
+func nixy_validate_frontend(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Frontends string `json:"frontends"`
+		Ports     int    `json:"ports"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil || strings.TrimSpace(body.Frontends) == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintln(w, "invalid body, expected {\"frontends\":\"<label>\",\"ports\":<count>}")
+		return
+	}
+	frontends := spaceRegexp.Split(strings.TrimSpace(body.Frontends), -1)
+	var result struct {
+		Valid     bool
+		Error     string `json:",omitempty"`
+		Frontends []FrontendResult
+	}
+	result.Valid = true
+	if err := checkFrontendCount(frontends, body.Ports); err != nil {
+		result.Valid = false
+		result.Error = err.Error()
+	}
+	for _, frontend := range frontends {
+		f, err := parseFrontend(frontend)
+		fr := FrontendResult{Frontend: frontend, Valid: err == nil}
+		if err == errFrontendNotAllowed {
+			fr.Error = "frontend type " + f.Type + " is not allowed"
+		} else if err != nil {
+			fr.Error = err.Error()
+		} else {
+			fr.Parsed = &f
+		}
+		if !fr.Valid {
+			result.Valid = false
+		}
+		result.Frontends = append(result.Frontends, fr)
+	}
+	w.Header().Add("Content-Type", "application/json; charset=utf-8")
+	b, _ := json.MarshalIndent(result, "", "  ")
+	w.Write(b)
+}
+
+// paused reports if reloads are paused, resuming them once the pause expired.
+func paused() bool {
+	health.Lock()
+	if health.Pause.Paused && !health.Pause.Until.IsZero() && time.Now().After(health.Pause.Until) {
+		skipped := health.Pause.Skipped
+		health.Pause = PauseStatus{}
+		health.Unlock()
+		logger.Infof("pause expired, reloads resumed, skipped events: %v", skipped)
+		catchUp(skipped)
+		return false
+	}
+	defer health.Unlock()
+	return health.Pause.Paused
+}
+
+// skipReload records an event that was skipped during a pause.
+func skipReload() {
+	health.Lock()
+	defer health.Unlock()
+	health.Pause.Skipped++
+}
+
+// catchUp queues a single reload for the events skipped during a pause, the
+// config would otherwise stay stale until marathon sends the next one.
+func catchUp(skipped int) {
+	if skipped > 0 {
+		queueReload()
+	}
+}
+
+// queueReload adds a reload to our queue channel, unless it is full of course.
+func queueReload() bool {
+	select {
+	case eventqueue <- true:
+		return true
+	default:
+		logger.Warning("queue is full")
+		queueFull()
+		return false
+	}
+}
+
+// nixy_ping is the liveness check. It only tells that nixy is up and serving
+// requests, without touching the template or nginx, so it is cheap to poll.
+func nixy_ping(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintln(w, "pong")
+	return
+}
+
+// nixy_live is the liveness probe for kubernetes, like ping.
+func nixy_live(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintln(w, "OK")
+}
+
+// nixy_ready is the readiness probe for kubernetes. Unlike /v1/health it
+// doesn't shell out, it only looks at state the reloads already recorded.
+func nixy_ready(w http.ResponseWriter, r *http.Request) {
+	health.RLock()
+	ready, reloadOk := health.Ready, health.LastReloadOk
+	health.RUnlock()
+	switch {
+	case !ready:
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintln(w, "waiting for the first sync")
+	case !reloadOk:
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintln(w, "last reload failed")
+	case config.Source == "marathon" && len(healthyEndpoints()) == 0:
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintln(w, "all endpoints are down")
+	default:
+		fmt.Fprintln(w, "OK")
+	}
+}
+
+// nixy_health is the readiness check. It validates the template, the nginx
+// config and the marathon endpoints, so it is a lot more expensive than ping.
 func nixy_health(w http.ResponseWriter, r *http.Request) {
-	err := checkTmpl()
-	if err != nil {
-		health.Template.Message = err.Error()
+	healthy := true
+	tmplErr := checkTmpl()
+	confErr := checkConf(config.Nginx_config)
+	nginxErr := lookupNginx()
+	paused() // expire a finished pause before reporting it.
+	config.RLock()
+	activeColor := config.Active_color
+	updates := config.LastUpdates
+	config.RUnlock()
+	health.Lock()
+	defer health.Unlock()
+	health.ActiveColor = activeColor
+	health.LastUpdates = updates
+	health.Ages = updates.ages()
+	if nginxErr != nil {
+		health.Nginx.Message = nginxErr.Error()
+		health.Nginx.Healthy = false
+		healthy = false
+	} else {
+		health.Nginx.Message = "OK"
+		health.Nginx.Healthy = true
+	}
+	if tmplErr != nil {
+		health.Template.Message = tmplErr.Error()
 		health.Template.Healthy = false
-		w.WriteHeader(http.StatusInternalServerError)
+		healthy = false
 	} else {
 		health.Template.Message = "OK"
 		health.Template.Healthy = true
 	}
-	err = checkConf(config.Nginx_config)
-	if err != nil {
-		health.Config.Message = err.Error()
+	if confErr != nil {
+		logger.Warningf("nginx config check failed, error: %v", confErr.Error())
+		health.Config.Message = firstLines(confErr.Error(), config.Health_error_lines)
+		health.Config.Line = nginxErrorLine(confErr.Error())
 		health.Config.Healthy = false
-		w.WriteHeader(http.StatusInternalServerError)
+		healthy = false
 	} else {
 		health.Config.Message = "OK"
+		health.Config.Line = ""
 		health.Config.Healthy = true
 	}
+	es := &health.EventStream
+	es.Healthy = true
+	es.Message = "OK"
+	if config.Source == "marathon" && config.Event_stream_max_down.Duration > 0 && !es.Connected {
+		down := time.Since(es.DisconnectedSince)
+		if down > config.Event_stream_max_down.Duration {
+			es.Healthy = false
+			es.Message = fmt.Sprintf("event stream disconnected for %v", down)
+			healthy = false
+		}
+	}
+	if health.Breaker.Open {
+		healthy = false
+	}
+	health.Sync.Healthy = true
+	health.Sync.Message = "OK"
+	if age, stale := syncStale(updates); stale {
+		health.Sync.Healthy = false
+		health.Sync.Message = fmt.Sprintf("last sync %v ago", age)
+		healthy = false
+	}
 	for _, endpoint := range health.Endpoints {
-		if (!endpoint.Healthy) {
-			w.WriteHeader(http.StatusInternalServerError)
-			break;
+		if !endpoint.Healthy {
+			healthy = false
+			break
 		}
 	}
 	w.Header().Add("Content-Type", "application/json; charset=utf-8")
-	b, _ := json.MarshalIndent(health, "", "  ")
+	if !health.Ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	} else if !healthy {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	b, _ := json.MarshalIndent(&health, "", "  ")
 	w.Write(b)
 	return
 }
 
+var nginxErrorLineRegexp = regexp.MustCompile(` in (\S+:\d+)`)
+
+// nginxErrorLine returns the file:line of an nginx -t error like
+// `unknown directive "foo" in /etc/nginx/nginx.conf:12`.
+func nginxErrorLine(msg string) string {
+	if m := nginxErrorLineRegexp.FindStringSubmatch(msg); m != nil {
+		return m[1]
+	}
+	return ""
+}
+
+// firstLines keeps the first n lines of msg, all of them if n is 0.
+func firstLines(msg string, n int) string {
+	lines := strings.Split(strings.TrimRight(msg, "\n"), "\n")
+	if n <= 0 || len(lines) <= n {
+		return msg
+	}
+	return strings.Join(lines[:n], "\n") + fmt.Sprintf("\n(%v more lines in the log)", len(lines)-n)
+}
+
 func nixy_config(w http.ResponseWriter, r *http.Request) {
 	w.Header().Add("Content-Type", "application/json; charset=utf-8")
-	b, _ := json.MarshalIndent(config, "", "  ")
+	config.RLock()
+	b, _ := json.MarshalIndent(&config, "", "  ")
+	config.RUnlock()
+	w.Write(b)
+	return
+}
+
+func nixy_stats(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Content-Type", "application/json; charset=utf-8")
+	b, _ := json.MarshalIndent(newStats(), "", "  ")
 	w.Write(b)
 	return
 }
 
+// nixy_nginx returns the nginx config on disk, or with ?rendered=true what
+// nixy would render from its current state.
+func nixy_nginx(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Content-Type", "text/plain; charset=utf-8")
+	if r.URL.Query().Get("rendered") == "true" {
+		var b bytes.Buffer
+		err := renderConf(&b)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintln(w, err.Error())
+			return
+		}
+		w.Write(b.Bytes())
+		return
+	}
+	config.RLock()
+	path := config.Nginx_config
+	config.RUnlock()
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintln(w, "nginx config not found")
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintln(w, err.Error())
+		return
+	}
+	w.Write(b)
+}
+
 func nixy_version(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintln(w, "nixy "+VERSION)
 	return
 }
 
+// renderFiles renders the template from captured marathon responses, for
+// template development without a cluster or nginx.
+func renderFiles(tasksPath string, appsPath string, w io.Writer) error {
+	return renderTemplateFiles(config.Nginx_template, tasksPath, appsPath, w)
+}
+
+// renderTemplateFiles renders the template at path with the apps from a
+// captured /v2/tasks and /v2/apps response.
+func renderTemplateFiles(path string, tasksPath string, appsPath string, w io.Writer) error {
+	jsontasks := MarathonTasks{}
+	jsonapps := MarathonApps{}
+	b, err := ioutil.ReadFile(tasksPath)
+	if err != nil {
+		return err
+	}
+	err = json.Unmarshal(b, &jsontasks)
+	if err != nil {
+		return err
+	}
+	b, err = ioutil.ReadFile(appsPath)
+	if err != nil {
+		return err
+	}
+	err = json.Unmarshal(b, &jsonapps)
+	if err != nil {
+		return err
+	}
+	config.Apps = syncApps(&jsontasks, &jsonapps)
+	return renderTemplate(path, w)
+}
+
+// validateTemplate executes the template at path the same way reloads do,
+// against an empty config or the apps from tasksPath and appsPath when both
+// were given on the command line.
+func validateTemplate(path string, tasksPath string, appsPath string) error {
+	sample := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) { sample[f.Name] = true })
+	if sample["tasks"] && sample["apps"] {
+		return renderTemplateFiles(path, tasksPath, appsPath, ioutil.Discard)
+	}
+	config.Apps = map[string]App{}
+	return renderTemplate(path, ioutil.Discard)
+}
+
+// handle registers a handler for a single method, other methods on the same
+// path get a 405 since the mux on its own would answer them with a 404.
+func handle(m *mux.Router, path string, method string, h http.HandlerFunc) {
+	m.HandleFunc(path, h).Methods(method)
+	m.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Allow", method)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		fmt.Fprintln(w, "method not allowed")
+	})
+}
+
+// newRouter registers all API endpoints.
+func newRouter() *mux.Router {
+	m := mux.NewRouter()
+	handle(m, "/", "GET", nixy_version)
+	handle(m, "/v1/reload", "POST", nixy_reload)
+	handle(m, "/v1/pause", "POST", nixy_pause)
+	handle(m, "/v1/resume", "POST", nixy_resume)
+	handle(m, "/v1/color", "POST", nixy_color)
+	handle(m, "/v1/frontend/disable", "POST", nixy_frontend_disable)
+	handle(m, "/v1/frontend/enable", "POST", nixy_frontend_enable)
+	handle(m, "/v1/validate-frontend", "POST", nixy_validate_frontend)
+	handle(m, "/v1/config", "GET", nixy_config)
+	handle(m, "/v1/health", "GET", nixy_health)
+	handle(m, "/v1/ping", "GET", nixy_ping)
+	handle(m, "/live", "GET", nixy_live)
+	handle(m, "/ready", "GET", nixy_ready)
+	handle(m, "/v1/stats", "GET", nixy_stats)
+	handle(m, "/v1/nginx", "GET", nixy_nginx)
+	return m
+}
+
 func main() {
 	configtoml := flag.String("f", "nixy.toml", "Path to config. (default nixy.toml)")
 	version := flag.Bool("v", false, "prints current nixy version")
+	render := flag.Bool("render", false, "render the template from -tasks and -apps to stdout and exit")
+	tasksjson := flag.String("tasks", "tasks.json", "Path to a captured marathon /v2/tasks response, used with -render")
+	appsjson := flag.String("apps", "apps.json", "Path to a captured marathon /v2/apps response, used with -render and -validate-template")
+	validate := flag.String("validate-template", "", "parse and execute this template against an empty config, or -tasks and -apps when given, and exit")
 	flag.Parse()
 	if *version {
 		fmt.Println(VERSION)
 		os.Exit(0)
 	}
-	file, err := ioutil.ReadFile(*configtoml)
+	if *validate != "" {
+		err := validateTemplate(*validate, *tasksjson, *appsjson)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			os.Exit(1)
+		}
+		fmt.Println("template is valid")
+		os.Exit(0)
+	}
+	err := loadConfig(*configtoml)
 	if err != nil {
-		logger.Fatalf("problem opening toml config, error: %v", err.Error())
+		logger.Fatalf("problem loading config, error: %v", err.Error())
 	}
-	err = toml.Unmarshal(file, &config)
+	if *render {
+		err = renderFiles(*tasksjson, *appsjson, os.Stdout)
+		if err != nil {
+			logger.Fatalf("problem rendering, error: %v", err.Error())
+		}
+		os.Exit(0)
+	}
+	err = lookupNginx()
 	if err != nil {
-		logger.Fatalf("problem parsing config, error: %v", err.Error())
+		logger.Fatalf("problem finding nginx, error: %v", err.Error())
+	}
+	if config.Nginx_pidfile != "" {
+		_, err = readNginxPid()
+		if err != nil {
+			logger.Fatalf("problem reading nginx pidfile, error: %v", err.Error())
+		}
 	}
+	setupTransport(tr)
+	eventqueue = make(chan bool, config.Event_queue_size)
 
-	statsd, _ = setupStatsd()
+	source, err = newSource()
+	if err != nil {
+		logger.Fatalf("problem setting up source, error: %v", err.Error())
+	}
+
+	err = validateStatsd()
+	if err != nil {
+		logger.Fatalf("problem with statsd config, error: %v", err.Error())
+	}
+	err = setupStatsd()
+	if err != nil {
+		logger.Errorf("problem setting up statsd backends, error: %v", err.Error())
+	}
+
+	_, err = getTemplate(config.Nginx_template)
+	if err != nil {
+		logger.Errorf("problem parsing template, error: %v", err.Error())
+	}
 
-	mux := mux.NewRouter()
-	mux.HandleFunc("/", nixy_version)
-	mux.HandleFunc("/v1/reload", nixy_reload)
-	mux.HandleFunc("/v1/config", nixy_config)
-	mux.HandleFunc("/v1/health", nixy_health)
 	s := &http.Server{
 		Addr:    ":" + config.Port,
-		Handler: mux,
+		Handler: newRouter(),
 	}
-	health = newHealth()
-	endpointHealth()
-	eventStream()
-	eventWorker()
+	initHealth()
+	reloadLimits.cleanupLoop()
+	if config.Source == "marathon" && config.Verify_cluster {
+		verifyCluster()
+	}
+	if config.Source == "marathon" && len(config.Marathon) > 0 {
+		refreshCluster(config.Marathon[0])
+	}
+	if config.Source == "marathon" && config.Startup_check {
+		startupCheck()
+	}
+	source.Watch()
+	// cancelled on shutdown, which aborts in-flight marathon requests.
+	ctx, cancel := context.WithCancel(context.Background())
+	workerDone := eventWorker(ctx)
+	syncWatchdog(ctx)
+	watchHangups()
+	go func() {
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+		sig := <-sigs
+		logger.Infof("received %v, shutting down", sig)
+		cancel()
+		shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer shutdownCancel()
+		s.Shutdown(shutdownCtx)
+	}()
 	logger.Infof("starting nixy on :%v", config.Port)
 	err = s.ListenAndServe()
-	if err != nil {
+	if err != nil && err != http.ErrServerClosed {
 		logger.Fatal(err)
 	}
+	<-workerDone
+	logger.Info("nixy stopped")
 }
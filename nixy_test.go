@@ -0,0 +1,385 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// loadTestConfig loads a config file with the given content. The config is
+// only restored for the fields the tests look at.
+func loadTestConfig(t *testing.T, content string) error {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "nixy.toml")
+	err := ioutil.WriteFile(path, []byte(content), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return loadConfig(path)
+}
+
+func TestNginxReloadRetries(t *testing.T) {
+	defer func(retries int) { config.Nginx_reload_retries = retries }(config.Nginx_reload_retries)
+	tests := []struct {
+		content string
+		want    int
+	}{
+		{``, 1},
+		{`nginx_reload_retries = 0`, 0},
+		{`nginx_reload_retries = 3`, 3},
+		{`nginx_reload_retries = -1`, 1},
+	}
+	for _, tt := range tests {
+		err := loadTestConfig(t, tt.content)
+		if err != nil {
+			t.Fatalf("%q: %v", tt.content, err)
+		}
+		if config.Nginx_reload_retries != tt.want {
+			t.Errorf("%q: got %v retries, want %v", tt.content, config.Nginx_reload_retries, tt.want)
+		}
+	}
+}
+
+func TestMethodNotAllowed(t *testing.T) {
+	router := newRouter()
+	tests := []struct {
+		method, path, allow string
+	}{
+		{"POST", "/", "GET"},
+		{"GET", "/v1/reload", "POST"},
+		{"PUT", "/v1/reload", "POST"},
+		{"GET", "/v1/pause", "POST"},
+		{"GET", "/v1/resume", "POST"},
+		{"GET", "/v1/color", "POST"},
+		{"GET", "/v1/frontend/disable", "POST"},
+		{"GET", "/v1/validate-frontend", "POST"},
+		{"POST", "/v1/config", "GET"},
+		{"DELETE", "/v1/health", "GET"},
+		{"POST", "/v1/ping", "GET"},
+		{"POST", "/ready", "GET"},
+		{"POST", "/v1/stats", "GET"},
+		{"POST", "/v1/nginx", "GET"},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(tt.method, tt.path, nil))
+		if w.Code != http.StatusMethodNotAllowed {
+			t.Errorf("%v %v: got status %v, want 405", tt.method, tt.path, w.Code)
+		}
+		if allow := w.Header().Get("Allow"); allow != tt.allow {
+			t.Errorf("%v %v: got Allow %q, want %q", tt.method, tt.path, allow, tt.allow)
+		}
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/v1/ping", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("GET /v1/ping: got status %v, want 200", w.Code)
+	}
+}
+
+// drainQueue empties the eventqueue and returns how many reloads were queued.
+func drainQueue() int {
+	n := 0
+	for {
+		select {
+		case <-eventqueue:
+			n++
+		default:
+			return n
+		}
+	}
+}
+
+func TestResumeQueuesSkippedReload(t *testing.T) {
+	router := newRouter()
+	post := func(path string) {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("POST", path, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("POST %v: got status %v", path, w.Code)
+		}
+	}
+	drainQueue()
+
+	post("/v1/pause")
+	post("/v1/resume")
+	if n := drainQueue(); n != 0 {
+		t.Errorf("resume without skipped events queued %v reloads", n)
+	}
+
+	post("/v1/pause")
+	if !paused() {
+		t.Fatal("not paused")
+	}
+	skipReload()
+	skipReload()
+	post("/v1/resume")
+	if n := drainQueue(); n != 1 {
+		t.Errorf("resume after skipped events queued %v reloads, want 1", n)
+	}
+
+	post("/v1/pause?duration=10ms")
+	skipReload()
+	time.Sleep(100 * time.Millisecond)
+	if n := drainQueue(); n != 1 {
+		t.Errorf("expired pause queued %v reloads, want 1", n)
+	}
+	if paused() {
+		t.Errorf("still paused after the duration")
+	}
+}
+
+func TestLoadConfigExpandsEnv(t *testing.T) {
+	marathon, user, cmd, xproxy := config.Marathon, config.User, config.Nginx_cmd, config.Xproxy
+	headers, namespace := config.Marathon_headers, config.Statsd.Namespace
+	defer func() {
+		config.Marathon, config.User, config.Nginx_cmd, config.Xproxy = marathon, user, cmd, xproxy
+		config.Marathon_headers, config.Statsd.Namespace = headers, namespace
+	}()
+	os.Setenv("NIXY_TEST_HOST", "marathon.example.com")
+	os.Setenv("NIXY_TEST_EVIL", "x\"\nnginx_cmd = \"/tmp/evil")
+	os.Setenv("NIXY_TEST_NS", "nixy.test")
+	defer os.Unsetenv("NIXY_TEST_HOST")
+	defer os.Unsetenv("NIXY_TEST_EVIL")
+	defer os.Unsetenv("NIXY_TEST_NS")
+
+	err := loadTestConfig(t, `# ${NIXY_TEST_EVIL} in a comment
+marathon = ["http://${NIXY_TEST_HOST}:8080"]
+user = "${NIXY_TEST_EVIL}"
+nginx_cmd = "nginx"
+xproxy = "$literal ${NIXY_TEST_UNSET}"
+[marathon_headers]
+X-Host = "${NIXY_TEST_HOST}"
+[statsd]
+namespace = "${NIXY_TEST_NS}"
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"http://marathon.example.com:8080"}; len(config.Marathon) != 1 || config.Marathon[0] != want[0] {
+		t.Errorf("marathon = %v, want %v", config.Marathon, want)
+	}
+	if config.User != os.Getenv("NIXY_TEST_EVIL") {
+		t.Errorf("user = %q, want the env value as is", config.User)
+	}
+	if config.Nginx_cmd != "nginx" {
+		t.Errorf("nginx_cmd = %q, the env value injected a key", config.Nginx_cmd)
+	}
+	if config.Xproxy != "$literal " {
+		t.Errorf("xproxy = %q, want %q", config.Xproxy, "$literal ")
+	}
+	if got := config.Marathon_headers["X-Host"]; got != "marathon.example.com" {
+		t.Errorf("marathon_headers X-Host = %q", got)
+	}
+	if config.Statsd.Namespace != "nixy.test" {
+		t.Errorf("statsd namespace = %q", config.Statsd.Namespace)
+	}
+}
+
+// useTestNginx points the config at a template and nginx config in a temp
+// dir, with true standing in for nginx, and syncs from marathon, all undone
+// when the test ends. It returns the temp dir.
+func useTestNginx(t *testing.T) string {
+	t.Helper()
+	if _, err := exec.LookPath("true"); err != nil {
+		t.Skip("no true command:", err)
+	}
+	dir := t.TempDir()
+	previousSource := source
+	config.Lock()
+	nginxTemplate, nginxConfig, nginxCmd := config.Nginx_template, config.Nginx_config, config.Nginx_cmd
+	config.Nginx_template = writeTemplate(t, "{{ range $id, $app := .Apps }}# {{ $id }}\n{{ end }}")
+	config.Nginx_config = filepath.Join(dir, "nginx.conf")
+	// accepts any config and reload.
+	config.Nginx_cmd = "true"
+	config.Unlock()
+	source = marathonSource{}
+	t.Cleanup(func() {
+		config.Lock()
+		config.Nginx_template, config.Nginx_config, config.Nginx_cmd = nginxTemplate, nginxConfig, nginxCmd
+		config.Unlock()
+		source = previousSource
+	})
+	return dir
+}
+
+// TestHangupsDuringReloads runs reloads while SIGHUPs re-read the credentials
+// and the api reads the config, meant to be run with -race.
+func TestHangupsDuringReloads(t *testing.T) {
+	server := marathonServer(testApps, testTasks)
+	defer server.Close()
+	setEndpoints(server.URL)
+	dir := useTestNginx(t)
+	credentials := filepath.Join(dir, "credentials.toml")
+	if err := ioutil.WriteFile(credentials, []byte("user = \"nixy\"\npass = \"secret\"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	config.Lock()
+	credentialsFile, user, pass := config.Credentials_file, config.User, config.Pass
+	config.Credentials_file = credentials
+	config.Unlock()
+	defer func() {
+		config.Lock()
+		config.Credentials_file, config.User, config.Pass = credentialsFile, user, pass
+		config.Unlock()
+	}()
+	watchHangups()
+
+	const rounds = 20
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(3)
+	go func() {
+		defer wg.Done()
+		defer close(done)
+		for i := 0; i < rounds; i++ {
+			if err := runReload(context.Background()); err != nil {
+				t.Errorf("reload failed: %v", err)
+				return
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			syscall.Kill(os.Getpid(), syscall.SIGHUP)
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	// reads like the ones of the api and the sync watchdog, for as long as
+	// the reloads run.
+	go func() {
+		defer wg.Done()
+		router := newRouter()
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if i%50 == 0 {
+				for _, path := range []string{"/v1/health", "/v1/config"} {
+					router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+				}
+			}
+			config.RLock()
+			updates := config.LastUpdates
+			config.RUnlock()
+			syncStale(updates)
+			// without a pause the readers starve the reloads of the lock.
+			time.Sleep(10 * time.Microsecond)
+		}
+	}()
+	wg.Wait()
+	waitForCluster(t)
+
+	config.RLock()
+	defer config.RUnlock()
+	if config.User != "nixy" || config.Pass != "secret" {
+		t.Errorf("credentials not applied, user: %q", config.User)
+	}
+	if _, ok := config.Apps["/foo"]; !ok {
+		t.Errorf("apps not synced: %v", config.Apps)
+	}
+	if config.LastUpdates.LastNginxReload.IsZero() {
+		t.Errorf("nginx reload time not recorded")
+	}
+}
+
+func TestTruncatedResponseKeepsConfig(t *testing.T) {
+	var truncated int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v2/apps":
+			if atomic.LoadInt32(&truncated) == 1 {
+				// a connection dropped halfway through the body.
+				w.Write([]byte(`{"apps":[{"id":"/bar","ports":[10000]},{"id":"/fo`))
+				return
+			}
+			w.Write([]byte(testApps))
+		case "/v2/tasks":
+			w.Write([]byte(testTasks))
+		case "/v2/info":
+			w.Write([]byte(`{"name":"test"}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+	setEndpoints(server.URL)
+	dir := useTestNginx(t)
+
+	if err := runReload(context.Background()); err != nil {
+		t.Fatalf("first reload failed: %v", err)
+	}
+	waitForCluster(t)
+	deployed, err := ioutil.ReadFile(filepath.Join(dir, "nginx.conf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	atomic.StoreInt32(&truncated, 1)
+	if err := runReload(context.Background()); err == nil {
+		t.Fatal("reload from a truncated response succeeded")
+	}
+	config.RLock()
+	_, ok := config.Apps["/foo"]
+	apps := len(config.Apps)
+	config.RUnlock()
+	if !ok || apps != 1 {
+		t.Errorf("apps changed after a failed sync: %v apps, /foo kept: %v", apps, ok)
+	}
+	after, err := ioutil.ReadFile(filepath.Join(dir, "nginx.conf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(after) != string(deployed) {
+		t.Errorf("nginx config changed after a failed sync: %q, was %q", after, deployed)
+	}
+}
+
+func TestTransportHTTP2(t *testing.T) {
+	defer func(force bool) { config.Transport_force_http1 = force }(config.Transport_force_http1)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+	tests := []struct {
+		force bool
+		proto int
+	}{
+		{false, 2},
+		{true, 1},
+	}
+	for _, tt := range tests {
+		config.Transport_force_http1 = tt.force
+		transport := &http.Transport{TLSClientConfig: server.Client().Transport.(*http.Transport).TLSClientConfig.Clone()}
+		setupTransport(transport)
+		if transport.ForceAttemptHTTP2 == tt.force {
+			t.Errorf("transport_force_http1 %v: ForceAttemptHTTP2 is %v", tt.force, transport.ForceAttemptHTTP2)
+		}
+		resp, err := (&http.Client{Transport: transport}).Get(server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		transport.CloseIdleConnections()
+		if resp.ProtoMajor != tt.proto {
+			t.Errorf("transport_force_http1 %v: got HTTP/%v, want HTTP/%v", tt.force, resp.ProtoMajor, tt.proto)
+		}
+	}
+}
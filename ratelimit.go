@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// bucket is a token bucket of one client of /v1/reload.
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// reloadLimiter limits /v1/reload to reload_api_rate requests per minute
+// per client address. Reloads from the event stream don't go through it.
+type reloadLimiter struct {
+	sync.Mutex
+	buckets map[string]*bucket
+}
+
+var reloadLimits = reloadLimiter{buckets: make(map[string]*bucket)}
+
+func (l *reloadLimiter) allow(client string) bool {
+	rate := float64(config.Reload_api_rate)
+	if rate <= 0 {
+		return true
+	}
+	l.Lock()
+	defer l.Unlock()
+	now := time.Now()
+	b, ok := l.buckets[client]
+	if !ok {
+		b = &bucket{tokens: rate, last: now}
+		l.buckets[client] = b
+	}
+	b.tokens += now.Sub(b.last).Minutes() * rate
+	if b.tokens > rate {
+		b.tokens = rate
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// cleanup drops the buckets of clients that have been quiet long enough to
+// be full again, so the map doesn't grow with every client ever seen.
+func (l *reloadLimiter) cleanup() {
+	l.Lock()
+	defer l.Unlock()
+	for client, b := range l.buckets {
+		if time.Since(b.last) > time.Minute {
+			delete(l.buckets, client)
+		}
+	}
+}
+
+func (l *reloadLimiter) cleanupLoop() {
+	go func() {
+		ticker := time.NewTicker(time.Minute)
+		for range ticker.C {
+			l.cleanup()
+		}
+	}()
+}
+
+// clientAddr is the address of a client without its port.
+func clientAddr(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
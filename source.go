@@ -0,0 +1,24 @@
+package main
+
+import (
+	"context"
+	"fmt"
+)
+
+// Source is where nixy discovers its apps. Fetch returns the current set of
+// apps that reload() renders, Watch starts whatever background work is needed
+// to queue a reload when the apps change.
+type Source interface {
+	Fetch(ctx context.Context) (map[string]App, error)
+	Watch()
+}
+
+func newSource() (Source, error) {
+	switch config.Source {
+	case "marathon":
+		return marathonSource{}, nil
+	case "consul":
+		return consulSource{}, nil
+	}
+	return nil, fmt.Errorf("unknown source %q, use marathon or consul", config.Source)
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// srvCache keeps SRV lookups for srv_cache_ttl, reloads after that resolve
+// the name again.
+type srvCache struct {
+	sync.Mutex
+	entries map[string]srvEntry
+}
+
+type srvEntry struct {
+	expires time.Time
+	addrs   []*net.SRV
+}
+
+var srvLookups = srvCache{entries: make(map[string]srvEntry)}
+
+// resolveSRV looks up a full SRV name like _app._tcp.marathon.mesos.
+func resolveSRV(name string) ([]*net.SRV, error) {
+	srvLookups.Lock()
+	entry, ok := srvLookups.entries[name]
+	srvLookups.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		return entry.addrs, nil
+	}
+	_, addrs, err := net.LookupSRV("", "", name)
+	if err != nil {
+		return nil, err
+	}
+	srvLookups.Lock()
+	srvLookups.entries[name] = srvEntry{expires: time.Now().Add(config.Srv_cache_ttl.Duration), addrs: addrs}
+	srvLookups.Unlock()
+	return addrs, nil
+}
+
+// srvBackends replaces the backends of an app with the targets of its
+// nixy.srv label, all on port index 0.
+func srvBackends(a App, name string) (App, error) {
+	addrs, err := resolveSRV(name)
+	if err != nil {
+		return a, err
+	}
+	a.Tasks = [][]string{[]string{}}
+	a.Backends = [][]Backend{[]Backend{}}
+	for _, addr := range addrs {
+		backend := Backend{Host: strings.TrimSuffix(addr.Target, "."), HostPort: int64(addr.Port), Weight: a.weight(0)}
+		if containsStr(a.Tasks[0], backend.String()) {
+			continue
+		}
+		a.Tasks[0] = append(a.Tasks[0], backend.String())
+		a.Backends[0] = append(a.Backends[0], backend)
+	}
+	return a, nil
+}
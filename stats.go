@@ -1,35 +1,353 @@
 package main
 
 import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
 	"os"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/peterbourgon/g2s"
 )
 
-func setupStatsd() (g2s.Statter, error) {
-	if config.Statsd.Addr == "" {
-		return g2s.Noop(), nil
+// validateStatsd checks the sample rates, which are percentages from 1 to
+// 100. An unset sample_rate defaults to 100.
+func validateStatsd() error {
+	if config.Statsd.SampleRate == 0 {
+		config.Statsd.SampleRate = 100
+	}
+	if config.Statsd.SampleRate < 1 || config.Statsd.SampleRate > 100 {
+		return fmt.Errorf("statsd sample_rate %v is not between 1 and 100", config.Statsd.SampleRate)
+	}
+	for metric, rate := range config.Statsd.Sample_rates {
+		if rate < 1 || rate > 100 {
+			return fmt.Errorf("statsd sample rate %v of %v is not between 1 and 100", rate, metric)
+		}
+	}
+	if config.Statsd.SampleRate < 10 {
+		logger.Warningf("statsd sample_rate is %v%%, most metrics will be dropped", config.Statsd.SampleRate)
+	}
+	return nil
+}
+
+// sampleRate returns the rate of a metric as a fraction, sample_rates
+// overrides sample_rate for single metrics like reload.time.
+func sampleRate(metric string) float32 {
+	if rate, ok := config.Statsd.Sample_rates[metric]; ok {
+		return float32(rate) / 100
+	}
+	return float32(config.Statsd.SampleRate) / 100
+}
+
+// statsBackend is a statsd server metrics are sent to, conn is set instead
+// of statter for dogstatsd backends since plain statsd has no way to send tags.
+type statsBackend struct {
+	addr    string
+	statter g2s.Statter
+	conn    net.Conn
+}
+
+// statsBackends are all backends every metric is sent to, empty when statsd
+// is not configured.
+var statsBackends []statsBackend
+
+// statsdBackends returns the addr from [statsd] followed by [[statsd.backends]].
+func statsdBackends() []StatsdBackend {
+	var backends []StatsdBackend
+	if config.Statsd.Addr != "" {
+		backends = append(backends, StatsdBackend{Addr: config.Statsd.Addr, Dogstatsd: config.Statsd.Dogstatsd})
 	}
+	return append(backends, config.Statsd.Backends...)
+}
 
+// setupStatsd connects to all backends, a backend that fails is left out
+// without disabling the others.
+func setupStatsd() error {
 	if config.Statsd.Namespace == "" {
 		hostname, _ := os.Hostname()
 		config.Statsd.Namespace = "nixy." + hostname
 	}
 
-	if config.Statsd.SampleRate < 1 || config.Statsd.SampleRate > 100 {
-		config.Statsd.SampleRate = 100
+	var failed []string
+	for _, backend := range statsdBackends() {
+		if backend.Dogstatsd {
+			conn, err := net.Dial("udp", backend.Addr)
+			if err != nil {
+				failed = append(failed, backend.Addr+": "+err.Error())
+				continue
+			}
+			statsBackends = append(statsBackends, statsBackend{addr: backend.Addr, conn: conn})
+			continue
+		}
+		statter, err := g2s.Dial("udp", backend.Addr)
+		if err != nil || statter == nil {
+			failed = append(failed, backend.Addr+": "+fmt.Sprint(err))
+			continue
+		}
+		statsBackends = append(statsBackends, statsBackend{addr: backend.Addr, statter: statter})
+	}
+	if len(failed) > 0 {
+		return errors.New(strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// sendDogstatsd writes a single metric with its tags in the DogStatsD format.
+func sendDogstatsd(conn net.Conn, metric string, value string, kind string, rate float32, tags []string) {
+	msg := metric + ":" + value + "|" + kind
+	if rate < 1 {
+		if rand.Float32() > rate {
+			return
+		}
+		msg += fmt.Sprintf("|@%g", rate)
+	}
+	if len(tags) > 0 {
+		msg += "|#" + strings.Join(tags, ",")
+	}
+	conn.Write([]byte(msg))
+}
+
+var metricSegmentRegexp = regexp.MustCompile(`[^0-9A-Za-z_-]`)
+
+// metricName is the plain statsd name of a metric, with instance_tag and the
+// marathon cluster after the namespace so instances sharing a namespace can
+// be told apart. The cluster is left out until it is known.
+func metricName(metric string) string {
+	name := config.Statsd.Namespace
+	if config.Statsd.Instance_tag != "" {
+		name += "." + config.Statsd.Instance_tag
+	}
+	if cluster := clusterName(); cluster != "" {
+		// dots would split the cluster name into more segments.
+		name += "." + metricSegmentRegexp.ReplaceAllString(cluster, "_")
+	}
+	return name + "." + metric
+}
+
+// instanceTags adds instance_tag and the marathon cluster as tags for
+// dogstatsd backends.
+func instanceTags(tags []string) []string {
+	var extra []string
+	if config.Statsd.Instance_tag != "" {
+		extra = append(extra, "instance:"+config.Statsd.Instance_tag)
+	}
+	if cluster := clusterName(); cluster != "" {
+		extra = append(extra, "cluster:"+cluster)
+	}
+	if len(extra) == 0 {
+		return tags
+	}
+	return append(extra, tags...)
+}
+
+// statsCount and statsTiming take optional tags like "endpoint:host", which
+// are only sent to dogstatsd backends.
+func statsCount(metric string, n int, tags ...string) {
+	rate := sampleRate(metric)
+	for _, b := range statsBackends {
+		if b.conn != nil {
+			sendDogstatsd(b.conn, config.Statsd.Namespace+"."+metric, strconv.Itoa(n), "c", rate, instanceTags(tags))
+			continue
+		}
+		b.statter.Counter(rate, metricName(metric), n)
+	}
+}
+
+func statsTiming(metric string, elapsed time.Duration, tags ...string) {
+	rate := sampleRate(metric)
+	for _, b := range statsBackends {
+		if b.conn != nil {
+			sendDogstatsd(b.conn, config.Statsd.Namespace+"."+metric, fmt.Sprint(int64(elapsed/time.Millisecond)), "ms", rate, instanceTags(tags))
+			continue
+		}
+		b.statter.Timing(rate, metricName(metric), elapsed)
+	}
+}
+
+func statsGauge(metric string, value int, tags ...string) {
+	rate := sampleRate(metric)
+	for _, b := range statsBackends {
+		if b.conn != nil {
+			sendDogstatsd(b.conn, config.Statsd.Namespace+"."+metric, strconv.Itoa(value), "g", rate, instanceTags(tags))
+			continue
+		}
+		b.statter.Gauge(rate, metricName(metric), strconv.Itoa(value))
+	}
+}
+
+// appGauges sends the number of apps and of backends over all apps.
+func appGauges() {
+	config.RLock()
+	apps := len(config.Apps)
+	backends := 0
+	for _, app := range config.Apps {
+		for _, tasks := range app.Tasks {
+			backends += len(tasks)
+		}
+	}
+	config.RUnlock()
+	go statsGauge("apps.count", apps)
+	go statsGauge("backends.count", backends)
+}
+
+// queueFull records an event dropped because the eventqueue was full.
+func queueFull() {
+	atomic.AddInt64(&droppedEvents, 1)
+	go statsCount("queue.full", 1)
+}
+
+// number of reload durations kept for the percentiles in /v1/stats.
+const reloadSamples = 100
+
+// ringBuffer keeps the last reloadSamples reload durations.
+type ringBuffer struct {
+	sync.Mutex
+	samples []time.Duration
+	next    int
+}
+
+var reloadTimes ringBuffer
+
+// events dropped because the eventqueue was full, since start.
+var droppedEvents int64
+
+// counters since start for /v1/stats, all updated atomically.
+var counters struct {
+	reloadSuccess int64
+	reloadFailed  int64
+	reloadSkipped int64
+	reloadTimeout int64
+	reconnects    int64
+	// duration of the last successful reload in nanoseconds.
+	lastReload int64
+}
+
+var startTime = time.Now()
+
+// reloadLock serializes runReload, reloadRunning is 1 while one runs.
+var reloadLock sync.Mutex
+var reloadRunning int32
+
+type ReloadStats struct {
+	Samples int
+	Min     Duration
+	Max     Duration
+	P50     Duration
+	P90     Duration
+	P99     Duration
+}
+
+type ReloadCounts struct {
+	Success int64
+	Failed  int64
+	Skipped int64
+	Timeout int64
+}
+
+// RuntimeStats is read on request, so it costs nothing between requests.
+type RuntimeStats struct {
+	Goroutines   int
+	HeapAlloc    uint64
+	HeapObjects  uint64
+	Sys          uint64
+	NumGC        uint32
+	LastGCPause  Duration
+	GCPauseTotal Duration
+}
+
+func newRuntimeStats() RuntimeStats {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	rs := RuntimeStats{
+		Goroutines:   runtime.NumGoroutine(),
+		HeapAlloc:    m.HeapAlloc,
+		HeapObjects:  m.HeapObjects,
+		Sys:          m.Sys,
+		NumGC:        m.NumGC,
+		GCPauseTotal: Duration{time.Duration(m.PauseTotalNs)},
+	}
+	if m.NumGC > 0 {
+		rs.LastGCPause = Duration{time.Duration(m.PauseNs[(m.NumGC+255)%256])}
 	}
+	return rs
+}
 
-	return g2s.Dial("udp", config.Statsd.Addr)
+type Stats struct {
+	Reload        ReloadStats
+	Reloads       ReloadCounts
+	LastReload    Duration
+	DroppedEvents int64
+	// event stream reconnects to marathon.
+	Reconnects int64
+	Uptime     Duration
+	// whether a reload is running and how many events wait in the eventqueue.
+	ReloadRunning bool
+	QueuedEvents  int
+	Runtime       RuntimeStats
+
+	// frontends taken out of rotation through /v1/frontend/disable.
+	DisabledFrontends []string
 }
 
-func statsCount(metric string, n int) {
-	ns := config.Statsd.Namespace
-	statsd.Counter(1.0, ns+"."+metric, n)
+func (r *ringBuffer) add(d time.Duration) {
+	r.Lock()
+	defer r.Unlock()
+	if len(r.samples) < reloadSamples {
+		r.samples = append(r.samples, d)
+		return
+	}
+	r.samples[r.next] = d
+	r.next = (r.next + 1) % reloadSamples
+}
+
+func (r *ringBuffer) summary() ReloadStats {
+	r.Lock()
+	sorted := make([]time.Duration, len(r.samples))
+	copy(sorted, r.samples)
+	r.Unlock()
+	var rs ReloadStats
+	rs.Samples = len(sorted)
+	if len(sorted) == 0 {
+		return rs
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	percentile := func(p int) Duration {
+		i := (len(sorted)*p+99)/100 - 1
+		if i < 0 {
+			i = 0
+		}
+		return Duration{sorted[i]}
+	}
+	rs.Min = Duration{sorted[0]}
+	rs.Max = Duration{sorted[len(sorted)-1]}
+	rs.P50 = percentile(50)
+	rs.P90 = percentile(90)
+	rs.P99 = percentile(99)
+	return rs
 }
 
-func statsTiming(metric string, elapsed time.Duration) {
-	ns := config.Statsd.Namespace
-	statsd.Timing(1.0, ns+"."+metric, elapsed)
+func newStats() Stats {
+	var s Stats
+	s.Reload = reloadTimes.summary()
+	s.Reloads.Success = atomic.LoadInt64(&counters.reloadSuccess)
+	s.Reloads.Failed = atomic.LoadInt64(&counters.reloadFailed)
+	s.Reloads.Skipped = atomic.LoadInt64(&counters.reloadSkipped)
+	s.Reloads.Timeout = atomic.LoadInt64(&counters.reloadTimeout)
+	s.LastReload = Duration{time.Duration(atomic.LoadInt64(&counters.lastReload))}
+	s.DroppedEvents = atomic.LoadInt64(&droppedEvents)
+	s.Reconnects = atomic.LoadInt64(&counters.reconnects)
+	s.Uptime = Duration{time.Since(startTime)}
+	s.Runtime = newRuntimeStats()
+	s.ReloadRunning = atomic.LoadInt32(&reloadRunning) == 1
+	s.QueuedEvents = len(eventqueue)
+	s.DisabledFrontends = disabledFrontends.list()
+	return s
 }
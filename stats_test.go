@@ -0,0 +1,33 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestMetricName(t *testing.T) {
+	defer func(namespace, tag string) {
+		config.Statsd.Namespace, config.Statsd.Instance_tag = namespace, tag
+	}(config.Statsd.Namespace, config.Statsd.Instance_tag)
+	setCluster := func(name string) {
+		health.Lock()
+		health.Cluster = name
+		health.Unlock()
+	}
+	defer setCluster(clusterName())
+	config.Statsd.Namespace = "nixy.lb1"
+	tests := []struct {
+		tag, cluster, want string
+	}{
+		{"", "", "nixy.lb1.reload.time"},
+		{"blue", "", "nixy.lb1.blue.reload.time"},
+		{"", "prod", "nixy.lb1.prod.reload.time"},
+		{"blue", "prod.eu-west", "nixy.lb1.blue.prod_eu-west.reload.time"},
+	}
+	for _, tt := range tests {
+		config.Statsd.Instance_tag = tt.tag
+		setCluster(tt.cluster)
+		if got := metricName("reload.time"); got != tt.want {
+			t.Errorf("instance_tag %q, cluster %q: got %v, want %v", tt.tag, tt.cluster, got, tt.want)
+		}
+	}
+}
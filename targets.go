@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Target is an extra config rendered next to the nginx one. Check and Reload
+// are commands, a %s in Check is replaced by the path of the file to check.
+type Target struct {
+	Template string
+	Output   string
+	Check    string
+	Reload   string
+}
+
+// updateTargets renders all targets, an error in one of them does not stop
+// the others unless stop_on_target_error is set.
+func updateTargets() error {
+	var failed []string
+	for _, t := range config.Targets {
+		err := updateTarget(t)
+		if err != nil {
+			logger.Errorf("unable to update target, error: %v, output: %v", err.Error(), t.Output)
+			if config.Stop_on_target_error {
+				return err
+			}
+			failed = append(failed, t.Output)
+		}
+	}
+	if len(failed) > 0 {
+		return errors.New("targets failed: " + strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// updateTarget renders a target and only checks, writes and reloads it when
+// the output differs from what is on disk.
+func updateTarget(t Target) error {
+	var rendered bytes.Buffer
+	err := renderTemplate(t.Template, &rendered)
+	if err != nil {
+		return err
+	}
+	current, err := ioutil.ReadFile(t.Output)
+	if err == nil && bytes.Equal(current, rendered.Bytes()) {
+		return nil
+	}
+	tmpFile, err := ioutil.TempFile(filepath.Dir(t.Output), ".nixy")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+	_, err = tmpFile.Write(rendered.Bytes())
+	tmpFile.Close()
+	if err != nil {
+		return err
+	}
+	if t.Check != "" {
+		err = runCmd(strings.Replace(t.Check, "%s", tmpFile.Name(), -1))
+		if err != nil {
+			return err
+		}
+	}
+	err = os.Rename(tmpFile.Name(), t.Output)
+	if err != nil {
+		return err
+	}
+	if t.Reload != "" {
+		return runCmd(t.Reload)
+	}
+	return nil
+}
+
+func runCmd(command string) error {
+	args := strings.Fields(command)
+	if len(args) == 0 {
+		return nil
+	}
+	cmd := exec.Command(args[0], args[1:]...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	err := cmd.Run() // will wait for command to return
+	if err != nil {
+		return errors.New(fmt.Sprint(err) + ": " + stderr.String())
+	}
+	return nil
+}
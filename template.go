@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// cachedTemplate is a parsed template and the modtime of its file.
+type cachedTemplate struct {
+	modTime time.Time
+	tmpl    *template.Template
+}
+
+// templateCache keeps the parsed templates around so renders and health
+// checks don't have to read and compile them from disk every time.
+type templateCache struct {
+	sync.Mutex
+	templates map[string]cachedTemplate
+}
+
+var tmplCache = templateCache{templates: make(map[string]cachedTemplate)}
+
+var templateFuncs = template.FuncMap{
+	"fileExists":   fileExists,
+	"splitStr":     splitStr,
+	"version":      func() string { return VERSION },
+	"hostname":     hostname,
+	"isTCP":        func(f Frontend) bool { return f.TCP },
+	"app":          lookupApp,
+	"upstreamName": upstreamName,
+	"hash":         shortHash,
+}
+
+// lookupApp returns the app with the given id or an empty App. It is only
+// called while rendering, which already holds the config read lock.
+func lookupApp(id string) App {
+	return config.Apps[id]
+}
+
+var upstreamNameRegexp = regexp.MustCompile(`[^0-9A-Za-z_-]`)
+
+// upstreamName turns an app id into a valid nginx identifier, /group/app
+// becomes group_app. Marathon ids can't contain _, so that is unambiguous,
+// other characters that have to be replaced add a hash of the id instead.
+func upstreamName(id string) string {
+	name := strings.Replace(strings.Trim(id, "/"), "/", "_", -1)
+	if !upstreamNameRegexp.MatchString(name) {
+		return name
+	}
+	return upstreamNameRegexp.ReplaceAllString(name, "_") + "_" + shortHash(id)
+}
+
+// shortHash is a short, stable hash of s for unique names in templates.
+func shortHash(s string) string {
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	return fmt.Sprintf("%08x", h.Sum32())
+}
+
+func hostname() string {
+	name, _ := os.Hostname()
+	return name
+}
+
+// getTemplate returns the cached template for path, re-parsing it only when
+// the modtime of the file changed since the last parse.
+func getTemplate(path string) (*template.Template, error) {
+	tmplCache.Lock()
+	defer tmplCache.Unlock()
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if cached, ok := tmplCache.templates[path]; ok && cached.modTime.Equal(fi.ModTime()) {
+		return cached.tmpl, nil
+	}
+	t, err := template.New(filepath.Base(path)).Funcs(templateFuncs).ParseFiles(path)
+	if err != nil {
+		return nil, err
+	}
+	tmplCache.templates[path] = cachedTemplate{modTime: fi.ModTime(), tmpl: t}
+	return t, nil
+}
+
+// renderConf executes the nginx template against the current config.
+func renderConf(w io.Writer) error {
+	return renderTemplate(config.Nginx_template, w)
+}
+
+// renderTemplate executes the template at path against the current config.
+func renderTemplate(path string, w io.Writer) error {
+	t, err := getTemplate(path)
+	if err != nil {
+		return templateError(path, err)
+	}
+	config.RLock()
+	defer config.RUnlock()
+	err = t.Execute(w, &config)
+	if err != nil {
+		return templateError(path, err)
+	}
+	return nil
+}
+
+// renderApp executes the app template at path for the app with the given id.
+func renderApp(path string, id string, w io.Writer) error {
+	t, err := getTemplate(path)
+	if err != nil {
+		return templateError(path, err)
+	}
+	config.RLock()
+	defer config.RUnlock()
+	err = t.Execute(w, AppConfig{Id: id, Environment: config.Environment, App: config.Apps[id]})
+	if err != nil {
+		return templateError(path, err)
+	}
+	return nil
+}
+
+var templateLineRegexp = regexp.MustCompile(`^template: [^:]+:(\d+)`)
+
+// templateError adds the template path and, when text/template reports one,
+// the failing line and its content to a parse or execution error.
+func templateError(path string, err error) error {
+	m := templateLineRegexp.FindStringSubmatch(err.Error())
+	if m == nil {
+		return fmt.Errorf("template %v: %v", path, err)
+	}
+	line, _ := strconv.Atoi(m[1])
+	if b, rerr := ioutil.ReadFile(path); rerr == nil {
+		lines := strings.Split(string(b), "\n")
+		if line > 0 && line <= len(lines) {
+			return fmt.Errorf("template %v line %v near %q: %v", path, line, strings.TrimSpace(lines[line-1]), err)
+		}
+	}
+	return fmt.Errorf("template %v line %v: %v", path, line, err)
+}
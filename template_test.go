@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// writeTemplate writes text to a template file in a fresh temp dir.
+func writeTemplate(t *testing.T, text string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "nginx.tmpl")
+	err := ioutil.WriteFile(path, []byte(text), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// render renders text against the current config.
+func render(t *testing.T, text string) (string, error) {
+	t.Helper()
+	var b bytes.Buffer
+	err := renderTemplate(writeTemplate(t, text), &b)
+	return b.String(), err
+}
+
+func TestVersionAndHostname(t *testing.T) {
+	previous := VERSION
+	VERSION = "1.2.3"
+	defer func() { VERSION = previous }()
+	name, err := os.Hostname()
+	if err != nil {
+		t.Skip("no hostname:", err)
+	}
+	out, err := render(t, `# nixy {{ version }} on {{ hostname }}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "# nixy 1.2.3 on " + name; out != want {
+		t.Errorf("got %q, want %q", out, want)
+	}
+}
+
+func TestTemplateError(t *testing.T) {
+	tests := []struct {
+		name, text, near string
+	}{
+		{"parse", "events {}\n    {{ if }}server foo;{{ end }}\n", `line 2 near "{{ if }}server foo;{{ end }}"`},
+		{"execute", "events {}\n{{ range .Apps }}\n    server {{ .Missing }};\n{{ end }}\n", `line 3 near "server {{ .Missing }};"`},
+		{"unknown function", "events {}\n\n  {{ nope }}\n", `line 3 near "{{ nope }}"`},
+	}
+	config.Lock()
+	config.Apps = map[string]App{"/foo": {}}
+	config.Unlock()
+	for _, tt := range tests {
+		path := writeTemplate(t, tt.text)
+		var b bytes.Buffer
+		err := renderTemplate(path, &b)
+		if err == nil {
+			t.Errorf("%v: broken template rendered without error", tt.name)
+			continue
+		}
+		if !strings.HasPrefix(err.Error(), "template "+path+" line ") {
+			t.Errorf("%v: error %q doesn't start with the path and line", tt.name, err)
+		}
+		if !strings.Contains(err.Error(), tt.near) {
+			t.Errorf("%v: error %q doesn't contain %q", tt.name, err, tt.near)
+		}
+	}
+}
+
+func TestAppFunction(t *testing.T) {
+	config.Lock()
+	config.Apps = map[string]App{
+		"/foo": {Tasks: [][]string{{"10.0.0.1:31000", "10.0.0.2:31000"}}},
+	}
+	config.Unlock()
+	out, err := render(t, `{{ with app "/foo" }}{{ range index .Tasks 0 }}server {{ . }}; {{ end }}{{ end }}`+
+		`{{ with app "/missing" }}{{ range .Tasks }}missing{{ end }}{{ end }}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "server 10.0.0.1:31000; server 10.0.0.2:31000; "; out != want {
+		t.Errorf("got %q, want %q", out, want)
+	}
+}
+
+var nginxIdentifierRegexp = regexp.MustCompile(`^[0-9A-Za-z_-]+$`)
+
+func TestUpstreamName(t *testing.T) {
+	// fixed values, a change here renames every upstream in deployed configs.
+	tests := []struct {
+		id, want string
+	}{
+		{"/shop/web", "shop_web"},
+		{"/shop/web-v2", "shop_web-v2"},
+		{"/shop/web.v2", "shop_web_v2_2105a44f"},
+		{"/shop.web/v2", "shop_web_v2_5c2b5b63"},
+		{"/db.internal", "db_internal_d5fc74d3"},
+	}
+	for _, tt := range tests {
+		if got := upstreamName(tt.id); got != tt.want {
+			t.Errorf("upstreamName(%q) = %q, want %q", tt.id, got, tt.want)
+		}
+	}
+}
+
+func TestUpstreamNameCollisions(t *testing.T) {
+	names := make(map[string]string)
+	add := func(id string) {
+		name := upstreamName(id)
+		if !nginxIdentifierRegexp.MatchString(name) {
+			t.Errorf("upstreamName(%q) = %q is not a valid nginx identifier", id, name)
+		}
+		if other, ok := names[name]; ok && other != id {
+			t.Errorf("%q and %q both map to %q", id, other, name)
+		}
+		names[name] = id
+	}
+	for _, group := range []string{"", "/shop", "/shop.eu", "/shop/eu", "/shop-eu", "/payments/v1.2"} {
+		for i := 0; i < 500; i++ {
+			add(fmt.Sprintf("%v/app-%v", group, i))
+			add(fmt.Sprintf("%v/app.%v", group, i))
+			add(fmt.Sprintf("%v/app/%v", group, i))
+			add(fmt.Sprintf("%v/app.v%v.canary", group, i))
+		}
+	}
+}
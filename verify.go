@@ -0,0 +1,133 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// dials running at once when verifying backends.
+const verifyWorkers = 16
+
+// how long a dial result is reused, so a burst of reloads doesn't dial the
+// same backends over and over.
+const verifyCacheTTL = 10 * time.Second
+
+type dialResult struct {
+	ok      bool
+	checked time.Time
+}
+
+type dialCache struct {
+	sync.Mutex
+	results map[string]dialResult
+}
+
+var backendDials = dialCache{results: make(map[string]dialResult)}
+
+// verifyBackends drops the backends that don't accept a tcp connection within
+// verify_backends_timeout, for when marathon health checks lag behind.
+// Draining backends are already rendered as down and kept as they are, apps
+// kept by keep_last_good keep all their backends. Apps left without any
+// backend are dropped unless include_empty_apps is set, like in syncApps.
+func verifyBackends(apps map[string]App) {
+	reachable := dialBackends(apps)
+	for id, a := range apps {
+		if a.LastGood {
+			continue
+		}
+		// new slices, the app may share its backends with the deployed config.
+		backends := make([][]Backend, len(a.Backends))
+		tasks := make([][]string, len(a.Backends))
+		empty := true
+		for index := range a.Backends {
+			backends[index] = []Backend{}
+			tasks[index] = []string{}
+			for _, backend := range a.Backends[index] {
+				if backend.Draining {
+					backends[index] = append(backends[index], backend)
+					continue
+				}
+				if !reachable[backend.String()] {
+					logger.Warningf("backend does not accept connections, leaving it out, app: %v, backend: %v", id, backend.String())
+					continue
+				}
+				backends[index] = append(backends[index], backend)
+				tasks[index] = append(tasks[index], backend.String())
+			}
+			if len(backends[index]) > 0 {
+				empty = false
+			}
+		}
+		a.Backends = backends
+		a.Tasks = tasks
+		if empty && !config.Include_empty_apps {
+			logger.Warningf("no backend of the app accepts connections, leaving it out, app: %v", id)
+			delete(apps, id)
+			continue
+		}
+		apps[id] = a
+	}
+}
+
+// dialBackends dials every distinct backend once, at most verifyWorkers at a time.
+func dialBackends(apps map[string]App) map[string]bool {
+	var addrs []string
+	seen := make(map[string]bool)
+	for _, a := range apps {
+		if a.LastGood {
+			continue
+		}
+		for _, backends := range a.Backends {
+			for _, backend := range backends {
+				if !backend.Draining && !seen[backend.String()] {
+					seen[backend.String()] = true
+					addrs = append(addrs, backend.String())
+				}
+			}
+		}
+	}
+	// forget old results, backends come and go with every deployment.
+	backendDials.Lock()
+	for addr, result := range backendDials.results {
+		if time.Since(result.checked) >= verifyCacheTTL {
+			delete(backendDials.results, addr)
+		}
+	}
+	backendDials.Unlock()
+	reachable := make(map[string]bool)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, verifyWorkers)
+	for _, addr := range addrs {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(addr string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			ok := dialBackend(addr)
+			mu.Lock()
+			reachable[addr] = ok
+			mu.Unlock()
+		}(addr)
+	}
+	wg.Wait()
+	return reachable
+}
+
+func dialBackend(addr string) bool {
+	backendDials.Lock()
+	result, ok := backendDials.results[addr]
+	backendDials.Unlock()
+	if ok && time.Since(result.checked) < verifyCacheTTL {
+		return result.ok
+	}
+	conn, err := net.DialTimeout("tcp", addr, config.Verify_backends_timeout.Duration)
+	if err == nil {
+		conn.Close()
+	}
+	backendDials.Lock()
+	backendDials.results[addr] = dialResult{ok: err == nil, checked: time.Now()}
+	backendDials.Unlock()
+	return err == nil
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// webhookTimeout bounds a webhook delivery, it runs in its own goroutine so
+// a slow receiver never holds up reloads.
+const webhookTimeout = 5 * time.Second
+
+type WebhookPayload struct {
+	Event     string    `json:"event"`
+	AppCount  int       `json:"app_count"`
+	Error     string    `json:"error,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// notifyReload posts the outcome of a reload to webhook_url, only failures
+// when webhook_on is "failure".
+func notifyReload(err error) {
+	if config.Webhook_url == "" {
+		return
+	}
+	payload := WebhookPayload{Event: "reload_success", Timestamp: time.Now()}
+	if err != nil {
+		payload.Event = "reload_failed"
+		payload.Error = err.Error()
+	} else if config.Webhook_on == "failure" {
+		return
+	}
+	config.RLock()
+	payload.AppCount = len(config.Apps)
+	config.RUnlock()
+	go sendWebhook(config.Webhook_url, payload)
+}
+
+func sendWebhook(url string, payload WebhookPayload) {
+	b, err := json.Marshal(payload)
+	if err != nil {
+		logger.Warningf("unable to encode webhook payload, error: %v", err.Error())
+		return
+	}
+	client := &http.Client{Timeout: webhookTimeout}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(b))
+	if err != nil {
+		logger.Warningf("webhook delivery failed, error: %v, url: %v", err.Error(), url)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		logger.Warningf("webhook delivery failed, status: %v, url: %v", resp.StatusCode, url)
+	}
+}